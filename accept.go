@@ -0,0 +1,178 @@
+package httpgzip
+
+import (
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NegotiateEncoding chooses a content-coding among the available ones
+// to encode a response with, according to acceptEncoding, the value of
+// an Accept-Encoding request header. It's the negotiation ServeContent does.
+//
+// Content-codings with higher quality values are preferred. Ties are broken
+// by order in pref, then by order in available. NegotiateEncoding reports
+// whether any of the available content-codings is acceptable; if not,
+// the response should be served without compression.
+func NegotiateEncoding(acceptEncoding string, available []string, pref []string) (string, bool) {
+	var encs []Encoding
+	for _, name := range available {
+		encs = append(encs, namedEncoding(name))
+	}
+	encs = negotiate([]string{acceptEncoding}, encs, pref, false)
+	if len(encs) == 0 {
+		return "", false
+	}
+	return encs[0].Name(), true
+}
+
+// negotiate returns the encodings in available that are acceptable according to
+// the Accept-Encoding header values acceptEncoding, in order of preference.
+// pref and serverPreference are as described in FileServerOptions.
+func negotiate(acceptEncoding []string, available []Encoding, pref []string, serverPreference bool) []Encoding {
+	return acceptableEncodings(parseAcceptEncoding(acceptEncoding), preferEncodings(available, pref), serverPreference)
+}
+
+// namedEncoding is an Encoding that only has a name.
+// It's used to negotiate among content-codings by name.
+type namedEncoding string
+
+func (e namedEncoding) Name() string                     { return string(e) }
+func (namedEncoding) NewWriter(io.Writer) io.WriteCloser { return nil }
+func (namedEncoding) FindPrecompressed(string) string    { return "" }
+func (namedEncoding) CompressesOnTheFly() bool           { return false }
+
+// acceptedEncoding is a content-coding listed in an Accept-Encoding header,
+// along with its quality value.
+type acceptedEncoding struct {
+	coding string  // Lower case content-coding name.
+	q      float64 // Quality value, in range [0, 1].
+}
+
+// maxAcceptEncodingElements is the maximum number of Accept-Encoding list elements
+// that are parsed. Any further elements are ignored, in order to bound the work
+// done for pathological headers.
+const maxAcceptEncodingElements = 64
+
+// parseAcceptEncoding parses values of Accept-Encoding request headers.
+// Multiple values, such as from multiple header lines, are combined into one list.
+// It returns the listed content-codings sorted by descending quality value.
+// Content-codings with equal quality values keep the order they were listed in.
+// A content-coding listed more than once is included once, with the highest
+// of its quality values. Malformed entries are skipped, and elements past
+// the first maxAcceptEncodingElements are ignored.
+func parseAcceptEncoding(values []string) []acceptedEncoding {
+	var encs []acceptedEncoding
+	index := make(map[string]int) // Index in encs, keyed by coding.
+	elements := 0
+	for _, v := range values {
+		for more := true; more && elements < maxAcceptEncodingElements; elements++ {
+			var s string
+			s, v, more = strings.Cut(v, ",")
+			enc, ok := parseAcceptedEncoding(s)
+			if !ok {
+				continue
+			}
+			if i, ok := index[enc.coding]; ok {
+				encs[i].q = math.Max(encs[i].q, enc.q)
+				continue
+			}
+			index[enc.coding] = len(encs)
+			encs = append(encs, enc)
+		}
+	}
+	sort.SliceStable(encs, func(i, j int) bool { return encs[i].q > encs[j].q })
+	return encs
+}
+
+// parseAcceptedEncoding parses a single Accept-Encoding list element,
+// such as "gzip" or "br;q=0.8". It reports whether s was well formed.
+func parseAcceptedEncoding(s string) (acceptedEncoding, bool) {
+	params := strings.Split(s, ";")
+	coding := strings.ToLower(strings.TrimSpace(params[0]))
+	if !isToken(coding) {
+		return acceptedEncoding{}, false
+	}
+	if coding == "x-gzip" {
+		// Recipients should consider "x-gzip" equivalent to "gzip",
+		// according to RFC 7230, section 4.2.3.
+		coding = "gzip"
+	}
+	enc := acceptedEncoding{coding: coding, q: 1}
+	for _, p := range params[1:] {
+		name, value, ok := strings.Cut(p, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || !(q >= 0 && q <= 1) {
+			return acceptedEncoding{}, false
+		}
+		enc.q = q
+	}
+	return enc, true
+}
+
+// acceptsEncoding reports whether coding is acceptable according to encs.
+// A coding listed explicitly takes precedence over the "*" wildcard,
+// which matches any coding not listed explicitly.
+func acceptsEncoding(encs []acceptedEncoding, coding string) bool {
+	return qValue(encs, coding) > 0
+}
+
+// isToken reports whether s is a non-empty token, as defined by RFC 7230, section 3.2.6.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// acceptableEncodings returns the encodings in available that are acceptable
+// according to accepted, in order of preference. Encodings with higher
+// quality values are preferred, and ties are broken by order in available.
+// If serverPreference is true, the order in available is used regardless
+// of quality values.
+func acceptableEncodings(accepted []acceptedEncoding, available []Encoding, serverPreference bool) []Encoding {
+	var encs []Encoding
+	for _, enc := range available {
+		if acceptsEncoding(accepted, enc.Name()) {
+			encs = append(encs, enc)
+		}
+	}
+	if serverPreference {
+		return encs
+	}
+	sort.SliceStable(encs, func(i, j int) bool {
+		return qValue(accepted, encs[i].Name()) > qValue(accepted, encs[j].Name())
+	})
+	return encs
+}
+
+// qValue returns the quality value of coding according to encs.
+// A coding listed explicitly takes precedence over the "*" wildcard.
+// Content-codings are case-insensitive, so coding is matched regardless of case.
+func qValue(encs []acceptedEncoding, coding string) float64 {
+	coding = strings.ToLower(coding)
+	q := 0.0
+	for _, enc := range encs {
+		switch enc.coding {
+		case coding:
+			return enc.q
+		case "*":
+			q = math.Max(q, enc.q)
+		}
+	}
+	return q
+}
@@ -0,0 +1,114 @@
+package httpgzip
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []acceptedEncoding
+	}{
+		{in: nil, want: nil},
+		{in: []string{"gzip"}, want: []acceptedEncoding{{"gzip", 1}}},
+		{in: []string{"br;q=0.5, gzip"}, want: []acceptedEncoding{{"gzip", 1}, {"br", 0.5}}},
+		{in: []string{"br;q=0.5", "gzip"}, want: []acceptedEncoding{{"gzip", 1}, {"br", 0.5}}},
+		{in: []string{"gzip;q=0", "br, gzip;q=0.8"}, want: []acceptedEncoding{{"br", 1}, {"gzip", 0.8}}},
+		{in: []string{"gzip", "gzip;q=0"}, want: []acceptedEncoding{{"gzip", 1}}},
+		{in: []string{"gzip;q=abc, br;q=1;q=2, ;q=1, gzip;;;, br"}, want: []acceptedEncoding{{"gzip", 1}, {"br", 1}}},
+		{in: []string{"GZIP"}, want: []acceptedEncoding{{"gzip", 1}}},
+		{in: []string{" br , Gzip "}, want: []acceptedEncoding{{"br", 1}, {"gzip", 1}}},
+		{in: []string{"gzip ; q=0.8, br"}, want: []acceptedEncoding{{"br", 1}, {"gzip", 0.8}}},
+		{in: []string{"gzip;q = 0.8 ,br; Q=0.5"}, want: []acceptedEncoding{{"gzip", 0.8}, {"br", 0.5}}},
+		{in: []string{"\tgzip\t;\tq=0.2"}, want: []acceptedEncoding{{"gzip", 0.2}}},
+		{in: []string{"GZIP;q=0.5, gzip;q=0.7"}, want: []acceptedEncoding{{"gzip", 0.7}}},
+		{in: []string{"g zip, br"}, want: []acceptedEncoding{{"br", 1}}},
+		{in: []string{"x-gzip"}, want: []acceptedEncoding{{"gzip", 1}}},
+		{in: []string{"X-Gzip;q=0.5, br;q=0.8, gzip;q=0.2"}, want: []acceptedEncoding{{"br", 0.8}, {"gzip", 0.5}}},
+		{in: []string{strings.Repeat(",", maxAcceptEncodingElements) + "gzip"}, want: nil},
+		{in: []string{strings.Repeat(",", maxAcceptEncodingElements-1) + "gzip"}, want: []acceptedEncoding{{"gzip", 1}}},
+	}
+	for _, tc := range tests {
+		if got := parseAcceptEncoding(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseAcceptEncoding(%q):\ngot:  %v\nwant: %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		available      []string
+		pref           []string
+		want           string
+		wantOK         bool
+	}{
+		{acceptEncoding: "", available: []string{"br", "gzip"}, want: "", wantOK: false},
+		{acceptEncoding: "gzip", available: nil, want: "", wantOK: false},
+		{acceptEncoding: "gzip", available: []string{"br", "gzip"}, want: "gzip", wantOK: true},
+		{acceptEncoding: "gzip, br", available: []string{"br", "gzip"}, want: "br", wantOK: true},
+		{acceptEncoding: "gzip, br", available: []string{"br", "gzip"}, pref: []string{"gzip"}, want: "gzip", wantOK: true},
+		{acceptEncoding: "gzip, br;q=0.5", available: []string{"br", "gzip"}, pref: []string{"br"}, want: "gzip", wantOK: true},
+		{acceptEncoding: "*", available: []string{"zstd", "gzip"}, want: "zstd", wantOK: true},
+		{acceptEncoding: "gzip;q=0, *", available: []string{"gzip"}, want: "", wantOK: false},
+		{acceptEncoding: "identity", available: []string{"br", "gzip"}, want: "", wantOK: false},
+		{acceptEncoding: "GZIP;Q=0.5, Br;q=0.8", available: []string{"br", "gzip"}, want: "br", wantOK: true},
+		{acceptEncoding: "ZSTD, gzip;q=0.9", available: []string{"gzip", "zstd"}, want: "zstd", wantOK: true},
+		{acceptEncoding: "Gzip;q=0.2, br;Q=0", available: []string{"br", "gzip"}, want: "gzip", wantOK: true},
+		{acceptEncoding: "gzip", available: []string{"GZIP"}, want: "GZIP", wantOK: true},
+		{acceptEncoding: "bR;q=0.5, gZiP;q=0.5", available: []string{"Br", "GZip"}, pref: []string{"GZip"}, want: "GZip", wantOK: true},
+	}
+	for _, tc := range tests {
+		got, ok := NegotiateEncoding(tc.acceptEncoding, tc.available, tc.pref)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("NegotiateEncoding(%q, %q, %q) = %q, %v; want %q, %v", tc.acceptEncoding, tc.available, tc.pref, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func FuzzParseAcceptEncoding(f *testing.F) {
+	for _, s := range []string{
+		"",
+		"gzip",
+		"br, gzip",
+		"br;q=1.0, gzip;q=0.5, *;q=0",
+		"gzip;q=,,,",
+		"gzip;q=abc",
+		"gzip;;;",
+		";q=1",
+		"identity;q=0, GZIP ; Q = 0.8",
+		strings.Repeat("x", 1<<12),
+		strings.Repeat("gzip;q=0.5,", 1<<10),
+		"br;" + strings.Repeat("a=b;", 1<<10) + "q=0.5",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		encs := parseAcceptEncoding([]string{s})
+		if !sort.SliceIsSorted(encs, func(i, j int) bool { return encs[i].q > encs[j].q }) {
+			t.Errorf("parseAcceptEncoding(%q) = %v, not sorted by descending q-value", s, encs)
+		}
+		if len(encs) > maxAcceptEncodingElements {
+			t.Errorf("parseAcceptEncoding(%q) returned %d codings, more than %d", s, len(encs), maxAcceptEncodingElements)
+		}
+		seen := make(map[string]bool)
+		for _, enc := range encs {
+			if seen[enc.coding] {
+				t.Errorf("parseAcceptEncoding(%q): coding %q listed more than once", s, enc.coding)
+			}
+			seen[enc.coding] = true
+			if !isToken(enc.coding) || enc.coding != strings.ToLower(enc.coding) {
+				t.Errorf("parseAcceptEncoding(%q): invalid coding %q", s, enc.coding)
+			}
+			if !(enc.q >= 0 && enc.q <= 1) {
+				t.Errorf("parseAcceptEncoding(%q): coding %q has out of range q-value %v", s, enc.coding, enc.q)
+			}
+		}
+		if again := parseAcceptEncoding([]string{s}); !reflect.DeepEqual(again, encs) {
+			t.Errorf("parseAcceptEncoding(%q) is not deterministic: got %v, then %v", s, encs, again)
+		}
+	})
+}
@@ -0,0 +1,20 @@
+//go:build brotli
+// +build brotli
+
+package httpgzip
+
+import (
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+// dynamicBrotliSupported reports whether the package was built with
+// support for compressing Brotli on the fly, via the brotli build tag.
+const dynamicBrotliSupported = true
+
+// newBrotliWriter returns a writer that compresses data written to it
+// with Brotli, and writes the compressed data to w.
+func newBrotliWriter(w io.Writer) io.WriteCloser {
+	return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+}
@@ -0,0 +1,13 @@
+//go:build !brotli
+// +build !brotli
+
+package httpgzip
+
+import "io"
+
+// dynamicBrotliSupported reports whether the package was built with
+// support for compressing Brotli on the fly, via the brotli build tag.
+const dynamicBrotliSupported = false
+
+// newBrotliWriter is only available when built with the brotli build tag.
+func newBrotliWriter(w io.Writer) io.WriteCloser { return nil }
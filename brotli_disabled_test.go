@@ -0,0 +1,34 @@
+//go:build !brotli
+// +build !brotli
+
+package httpgzip_test
+
+import (
+	"testing"
+
+	"github.com/shurcooL/httpgzip"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// Test that FileServerOptions.DynamicBrotli is invalid, and ignored, without
+// the brotli build tag, and that precompressed variants are still served.
+func TestServeContentDynamicBrotliDisabled(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+	}))
+	if err := (httpgzip.FileServerOptions{DynamicBrotli: true}).Validate(); err == nil {
+		t.Error("Validate with DynamicBrotli didn't return an error")
+	}
+
+	// It's ignored by FileServer.
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{DynamicBrotli: true, DebugHeader: true})
+	if got, want := serveGet(h, "/foo.txt", "br").Header().Get("X-Compression"), "identity"; got != want {
+		t.Errorf("got X-Compression %q, want %q", got, want)
+	}
+	if got, want := serveGet(h, "/bar.txt", "br").Header().Get("X-Compression"), "br-precompressed"; got != want {
+		t.Errorf("got X-Compression %q, want %q", got, want)
+	}
+}
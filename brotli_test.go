@@ -0,0 +1,75 @@
+//go:build brotli
+// +build brotli
+
+package httpgzip_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/shurcooL/httpgzip"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// Test that Brotli is compressed on the fly if FileServerOptions.DynamicBrotli
+// is set, and that precompressed variants are still preferred.
+func TestServeContentDynamicBrotli(t *testing.T) {
+	if err := (httpgzip.FileServerOptions{DynamicBrotli: true}).Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{DynamicBrotli: true, DebugHeader: true})
+
+	rr := serveGet(h, "/foo.txt", "br")
+	if got, want := rr.Header().Get("X-Compression"), "br-dynamic"; got != want {
+		t.Fatalf("got X-Compression %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadAll(brotli.NewReader(rr.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != compressibleText {
+		t.Errorf("got decompressed body of length %d, want %d", len(b), len(compressibleText))
+	}
+
+	if got, want := serveGet(h, "/bar.txt", "br").Header().Get("X-Compression"), "br-precompressed"; got != want {
+		t.Errorf("got X-Compression %q, want %q", got, want)
+	}
+}
+
+// Test that FileServerOptions.DynamicBrotliTypes limits compressing
+// with Brotli on the fly to content of those types.
+func TestServeContentDynamicBrotliTypes(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.html": compressibleText,
+		"foo.json": compressibleText,
+		"foo.txt":  compressibleText,
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{
+		DynamicBrotli:      true,
+		DynamicBrotliTypes: []string{"text/html", "application/json"},
+		DebugHeader:        true,
+	})
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/foo.html", want: "br-dynamic"},
+		{path: "/foo.json", want: "br-dynamic"},
+		{path: "/foo.txt", want: "gzip-dynamic"},
+	}
+	for _, tc := range tests {
+		if got := serveGet(h, tc.path, "br, gzip").Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("%s: got X-Compression %q, want %q", tc.path, got, tc.want)
+		}
+	}
+	if got, want := serveGet(h, "/foo.txt", "br").Header().Get("X-Compression"), "identity"; got != want {
+		t.Errorf("/foo.txt with only br accepted: got X-Compression %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package httpgzip
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// compressKey identifies a file in the root file system compressed on the fly.
+// Its content is assumed to be the same for requests with the same file path
+// and modification time.
+type compressKey struct {
+	fpath    string
+	name     string // Name of the file, which may be included in gzip headers.
+	modTime  time.Time
+	encoding string
+	ctype    string // Content type, which may decide the compression level.
+}
+
+// compressGroup coalesces concurrent compressions of the same content,
+// so that only one of them is done, and the rest wait for and share its result.
+// The zero value is ready to use.
+type compressGroup struct {
+	mu    sync.Mutex
+	calls map[compressKey]*compressCall
+}
+
+// errIncompleteCompress is the result of a compression that didn't complete.
+var errIncompleteCompress = errors.New("compression didn't complete")
+
+// compressCall is a compression in progress or completed.
+type compressCall struct {
+	done       chan struct{} // Closed once compression is completed.
+	compressed []byte
+	err        error
+	waiters    int // Number of other callers waiting for the compression.
+}
+
+// do calls compress and returns its results, unless a call for the same key
+// is already in progress, in which case it waits for and returns its results.
+// Callers mustn't modify the returned bytes, since they may be shared.
+// Content without a modification time isn't known to be the same between
+// requests, so compress is always called for it.
+func (g *compressGroup) do(key compressKey, compress func() ([]byte, error)) ([]byte, error) {
+	if key.modTime.IsZero() {
+		return compress()
+	}
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		g.mu.Unlock()
+		<-c.done
+		return c.compressed, c.err
+	}
+	if g.calls == nil {
+		g.calls = make(map[compressKey]*compressCall)
+	}
+	// If compress panics, waiters get errIncompleteCompress.
+	c := &compressCall{done: make(chan struct{}), err: errIncompleteCompress}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.compressed, c.err = compress()
+	return c.compressed, c.err
+}
@@ -0,0 +1,52 @@
+package httpgzip
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test that concurrent calls for the same key result in a single
+// compression, whose output is returned to all of them.
+func TestCompressGroup(t *testing.T) {
+	var g compressGroup
+	key := compressKey{fpath: "/foo.txt", modTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), encoding: "gzip"}
+	release := make(chan struct{})
+	var compressions int32
+
+	const n = 20
+	var wg sync.WaitGroup
+	results := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.do(key, func() ([]byte, error) {
+				atomic.AddInt32(&compressions, 1)
+				<-release
+				return []byte("compressed"), nil
+			})
+		}(i)
+	}
+	// Wait for all other calls to be waiting for the one compressing.
+	for waiters := 0; waiters < n-1; runtime.Gosched() {
+		g.mu.Lock()
+		if c, ok := g.calls[key]; ok {
+			waiters = c.waiters
+		}
+		g.mu.Unlock()
+	}
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&compressions); got != 1 {
+		t.Errorf("got %d compressions, want 1", got)
+	}
+	for i := range results {
+		if string(results[i]) != "compressed" {
+			t.Errorf("call %d: got %q, want %q", i, results[i], "compressed")
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package httpgzip_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/httpgzip"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// Test that concurrent requests for the same file are served
+// compressed output, even if the request compressing it is canceled.
+func TestServeFileConcurrentCompressions(t *testing.T) {
+	const n = 20
+	gate := newBarrier(n)
+	release := make(chan struct{})
+	// Compressions are only shared for files with a modification time.
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte(compressibleText), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := blockingFS{FileSystem: http.Dir(dir), release: release}
+	fs := httpgzip.FileServer(root, httpgzip.FileServerOptions{
+		// Every request reaches the gate right before compressing.
+		CompressGate: func() bool { gate.wait(); return true },
+	})
+
+	var wg sync.WaitGroup
+	ctxs, cancels := make([]context.Context, n), make([]context.CancelFunc, n)
+	bodies := make([]string, n)
+	encodings := make([]string, n)
+	for i := 0; i < n; i++ {
+		ctxs[i], cancels[i] = context.WithCancel(context.Background())
+		defer cancels[i]()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/foo.txt", nil).WithContext(ctxs[i])
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			fs.ServeHTTP(rr, req)
+			bodies[i], encodings[i] = rr.Body.String(), rr.Header().Get("Content-Encoding")
+		}(i)
+	}
+	// Once all requests are past the gate, cancel all but the last of them,
+	// which includes whichever request is doing the compression, if any.
+	<-gate.done
+	for _, cancel := range cancels[:n-1] {
+		cancel()
+	}
+	close(release)
+	wg.Wait()
+
+	if encodings[n-1] != "gzip" {
+		t.Errorf("request %d: got Content-Encoding %q, want %q", n-1, encodings[n-1], "gzip")
+	}
+	for i := range bodies {
+		if encodings[i] != encodings[n-1] || bodies[i] != bodies[n-1] {
+			t.Errorf("request %d: got response different from that of request %d", i, n-1)
+		}
+	}
+}
+
+// Test that content served by concurrent calls to ServeContent isn't shared,
+// even if it has the same name and modification time.
+func TestServeContentConcurrentCompressions(t *testing.T) {
+	const n = 2
+	gate := newBarrier(n)
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{
+		CompressGate: func() bool { gate.wait(); return true },
+	})
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	contents := make([]string, n)
+	bodies := make([]string, n)
+	for i := 0; i < n; i++ {
+		contents[i] = strings.Repeat(string(rune('a'+i)), 1000)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			fs.ServeContent(rr, req, "foo.txt", modTime, "/foo.txt", strings.NewReader(contents[i]))
+			zr, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+				return
+			}
+			b, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Errorf("request %d: %v", i, err)
+			}
+			bodies[i] = string(b)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range bodies {
+		if bodies[i] != contents[i] {
+			t.Errorf("request %d: got body %.10q..., want %.10q...", i, bodies[i], contents[i])
+		}
+	}
+}
+
+// barrier blocks callers of wait until n of them are waiting.
+type barrier struct {
+	n    int32
+	done chan struct{}
+}
+
+func newBarrier(n int32) *barrier {
+	return &barrier{n: n, done: make(chan struct{})}
+}
+
+func (b *barrier) wait() {
+	if atomic.AddInt32(&b.n, -1) == 0 {
+		close(b.done)
+	}
+	<-b.done
+}
+
+// blockingFS is a file system whose files block on Read until release is closed.
+type blockingFS struct {
+	http.FileSystem
+	release chan struct{}
+}
+
+func (fs blockingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return blockingFile{File: f, release: fs.release}, nil
+}
+
+type blockingFile struct {
+	http.File
+	release chan struct{}
+}
+
+func (f blockingFile) Read(p []byte) (int, error) {
+	<-f.release
+	return f.File.Read(p)
+}
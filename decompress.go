@@ -0,0 +1,163 @@
+package httpgzip
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DecompressRequest returns a handler that transparently decompresses
+// gzip compressed request bodies before passing requests on to next.
+// Additional optional behaviors can be controlled via opt.
+//
+// Requests whose "Content-Encoding" header lists only gzip (or x-gzip)
+// codings, such as "gzip" or "gzip, gzip", have their body replaced with
+// one that decompresses it as it's read, and the "Content-Encoding" and
+// "Content-Length" headers removed, so next can read them as plain text.
+// Requests with other codings are passed on as is.
+//
+// Requests whose body doesn't begin with a valid gzip header are rejected
+// with 400 Bad Request before calling next. If the body turns out to be
+// invalid while next reads it, or to decompress to more than opt.MaxSize
+// bytes, reading it fails, and the request is rejected with 400 Bad Request
+// or 413 Request Entity Too Large, respectively, unless next has already
+// written a response header. Anything next writes afterwards is discarded.
+func DecompressRequest(next http.Handler, opt DecompressRequestOptions) http.Handler {
+	if opt.MaxSize == 0 {
+		opt.MaxSize = decompressRequestDefaults.MaxSize
+	}
+	return &requestDecompressor{next: next, opt: opt}
+}
+
+var decompressRequestDefaults = DecompressRequestOptions{
+	MaxSize: 10 << 20,
+}
+
+// DecompressRequestOptions specifies options for DecompressRequest.
+type DecompressRequestOptions struct {
+	// MaxSize is the maximum size of a decompressed request body, in bytes.
+	// It guards against decompression bombs, small compressed bodies that
+	// decompress to a very large size. If zero, 10 MB is used.
+	MaxSize int64
+}
+
+type requestDecompressor struct {
+	next http.Handler
+	opt  DecompressRequestOptions
+}
+
+// errRequestTooLarge is returned when reading a request body
+// that decompresses to more than DecompressRequestOptions.MaxSize bytes.
+var errRequestTooLarge = errors.New("httpgzip: decompressed request body too large")
+
+func (d *requestDecompressor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	codings := contentCodings(req.Header)
+	if len(codings) == 0 {
+		d.next.ServeHTTP(w, req)
+		return
+	}
+	for _, coding := range codings {
+		if !strings.EqualFold(coding, "gzip") && !strings.EqualFold(coding, "x-gzip") {
+			d.next.ServeHTTP(w, req)
+			return
+		}
+	}
+
+	// Codings are listed in the order they were applied, so the last
+	// one is undone first. Gzip headers are read right away, so that
+	// bodies that aren't gzip at all are rejected before calling next.
+	var r io.Reader = req.Body
+	for range codings {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			http.Error(w, "400 Bad Request\n\nrequest body isn't valid gzip", http.StatusBadRequest)
+			return
+		}
+		r = gr
+	}
+
+	dw := &decompressWriter{ResponseWriter: w}
+	r2 := req.Clone(req.Context())
+	r2.Header.Del("Content-Encoding")
+	r2.Header.Del("Content-Length")
+	r2.ContentLength = -1
+	r2.Body = &decompressBody{r: r, body: req.Body, remaining: d.opt.MaxSize + 1, w: dw}
+	d.next.ServeHTTP(dw, r2)
+}
+
+// decompressBody is a request body that decompresses r as it's read,
+// failing the request via w if the body is invalid or too large.
+type decompressBody struct {
+	r         io.Reader     // Decompressing reader.
+	body      io.ReadCloser // Original request body.
+	remaining int64         // Bytes left until the body is known to be too large.
+	w         *decompressWriter
+	err       error // Sticky error, once reading has failed.
+}
+
+func (b *decompressBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	switch {
+	case b.remaining == 0:
+		b.fail("413 Request Entity Too Large", http.StatusRequestEntityTooLarge, errRequestTooLarge)
+		return 0, b.err
+	case err != nil && err != io.EOF:
+		b.fail("400 Bad Request\n\nrequest body isn't valid gzip", http.StatusBadRequest, err)
+	}
+	return n, err
+}
+
+func (b *decompressBody) Close() error { return b.body.Close() }
+
+// fail rejects the request with code, unless a response header
+// has already been written, and makes reading fail with err.
+func (b *decompressBody) fail(msg string, code int, err error) {
+	b.err = err
+	if !b.w.wroteHeader {
+		http.Error(b.w.ResponseWriter, msg, code)
+	}
+	b.w.failed = err
+}
+
+// decompressWriter is an http.ResponseWriter that discards the response
+// written by a handler after its request body failed to decompress.
+type decompressWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	failed      error // Error reading the request body, if any.
+}
+
+func (w *decompressWriter) WriteHeader(code int) {
+	if w.failed != nil {
+		return
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *decompressWriter) Write(p []byte) (int, error) {
+	if w.failed != nil {
+		return 0, w.failed
+	}
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher by delegating to the underlying ResponseWriter.
+func (w *decompressWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.failed == nil {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for use by http.ResponseController.
+func (w *decompressWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,82 @@
+package httpgzip_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shurcooL/httpgzip"
+)
+
+func TestDecompressRequest(t *testing.T) {
+	var (
+		gotBody     string
+		gotEncoding []string
+	)
+	h := httpgzip.DecompressRequest(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		if err == nil {
+			gotBody, gotEncoding = string(b), req.Header["Content-Encoding"]
+		}
+		// Written even when reading failed, then it's to be discarded.
+		io.WriteString(w, "handled")
+	}), httpgzip.DecompressRequestOptions{MaxSize: 1 << 10})
+
+	tests := []struct {
+		name         string
+		encoding     string
+		body         []byte
+		wantStatus   int
+		wantBody     string
+		wantEncoding []string
+	}{
+		{name: "plain", body: []byte("Hello world"), wantStatus: http.StatusOK, wantBody: "Hello world"},
+		{name: "gzip", encoding: "gzip", body: gzipBytes(t, "Hello world"), wantStatus: http.StatusOK, wantBody: "Hello world"},
+		{name: "x-gzip", encoding: "x-gzip", body: gzipBytes(t, "Hello world"), wantStatus: http.StatusOK, wantBody: "Hello world"},
+		{name: "gzip twice", encoding: "gzip, GZIP", body: gzipBytes(t, string(gzipBytes(t, "Hello world"))), wantStatus: http.StatusOK, wantBody: "Hello world"},
+		{name: "exactly max size", encoding: "gzip", body: gzipBytes(t, strings.Repeat("a", 1<<10)), wantStatus: http.StatusOK, wantBody: strings.Repeat("a", 1<<10)},
+		{name: "unsupported coding", encoding: "gzip, br", body: []byte("brotli"), wantStatus: http.StatusOK, wantBody: "brotli", wantEncoding: []string{"gzip, br"}},
+		{name: "invalid", encoding: "gzip", body: []byte("Hello world"), wantStatus: http.StatusBadRequest},
+		{name: "truncated", encoding: "gzip", body: gzipBytes(t, "Hello world")[:15], wantStatus: http.StatusBadRequest},
+		{name: "too large", encoding: "gzip", body: gzipBytes(t, strings.Repeat("a", 1<<10+1)), wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range tests {
+		gotBody, gotEncoding = "", nil
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(tc.body))
+		if tc.encoding != "" {
+			req.Header.Set("Content-Encoding", tc.encoding)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.name, rr.Code, tc.wantStatus)
+		}
+		if gotBody != tc.wantBody {
+			t.Errorf("%s: handler got body %q, want %q", tc.name, gotBody, tc.wantBody)
+		}
+		if !reflect.DeepEqual(gotEncoding, tc.wantEncoding) {
+			t.Errorf("%s: handler got Content-Encoding %q, want %q", tc.name, gotEncoding, tc.wantEncoding)
+		}
+		if handled := strings.Contains(rr.Body.String(), "handled"); handled != (tc.wantStatus == http.StatusOK) {
+			t.Errorf("%s: got response body %q", tc.name, rr.Body.String())
+		}
+	}
+}
+
+func gzipBytes(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
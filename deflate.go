@@ -0,0 +1,40 @@
+package httpgzip
+
+import (
+	"compress/zlib"
+	"io"
+)
+
+// DeflateDictEncoding returns the "deflate" content-coding, compressing with
+// the preset dictionary dict. For many small, similar responses, such as
+// JSON API responses, a dictionary of commonly occurring strings can
+// greatly improve compression. Since it's meant for small responses,
+// it compresses with the best compression level.
+//
+// Responses are in the zlib format, as the "deflate" content-coding requires,
+// with the Adler-32 checksum of dict in their header. They can only be
+// decompressed by clients that have dict, such as with zlib.NewReaderDict,
+// so it's only suitable for clients under the same control as the server.
+// Browsers won't be able to decompress responses. Precompressed variants
+// aren't supported.
+//
+// The returned encoding isn't registered; pass it to RegisterEncoding to use it,
+// or set FileServerOptions.DeflateDictionary to use it with a single file server.
+func DeflateDictEncoding(dict []byte) Encoding {
+	return deflateDictEncoding{dict: dict}
+}
+
+type deflateDictEncoding struct {
+	dict []byte
+}
+
+func (deflateDictEncoding) Name() string { return "deflate" }
+func (e deflateDictEncoding) NewWriter(w io.Writer) io.WriteCloser {
+	zw, err := zlib.NewWriterLevelDict(w, zlib.BestCompression, e.dict)
+	if err != nil {
+		return nil
+	}
+	return zw
+}
+func (deflateDictEncoding) FindPrecompressed(string) string { return "" }
+func (deflateDictEncoding) CompressesOnTheFly() bool        { return true }
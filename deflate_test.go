@@ -0,0 +1,92 @@
+package httpgzip_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/httpgzip"
+)
+
+// Test that DeflateDictEncoding compresses small responses similar to its
+// dictionary better than without one, and they decompress with the dictionary.
+func TestDeflateDictEncoding(t *testing.T) {
+	dict := []byte(`{"id":0,"name":"","email":"@example.com","active":true,"roles":["admin","user"]}`)
+	response := []byte(fmt.Sprintf(`{"id":%d,"name":%q,"email":%q,"active":true,"roles":["user"]}`, 42, "Gopher", "gopher@example.com"))
+
+	compress := func(enc httpgzip.Encoding) []byte {
+		var buf bytes.Buffer
+		w := enc.NewWriter(&buf)
+		if w == nil {
+			t.Fatalf("%s encoding doesn't compress on the fly", enc.Name())
+		}
+		w.Write(response)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	withDict := compress(httpgzip.DeflateDictEncoding(dict))
+	withoutDict := compress(httpgzip.DeflateDictEncoding(nil))
+	if len(withDict) >= len(withoutDict) {
+		t.Errorf("got %d bytes with dictionary, want fewer than %d without", len(withDict), len(withoutDict))
+	}
+
+	zr, err := zlib.NewReaderDict(bytes.NewReader(withDict), dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, response) {
+		t.Errorf("got decompressed %q, want %q", got, response)
+	}
+	if _, err := zlib.NewReader(bytes.NewReader(withDict)); err != zlib.ErrDictionary {
+		t.Errorf("decompressing without dictionary: got error %v, want %v", err, zlib.ErrDictionary)
+	}
+}
+
+// Test that FileServerOptions.DeflateDictionary makes only that file server
+// compress with the dictionary.
+func TestFileServerDeflateDictionary(t *testing.T) {
+	dict := []byte(`{"id":0,"name":"","email":"@example.com","active":true,"roles":["admin","user"]}`)
+	response := strings.Repeat(`{"id":42,"name":"Gopher","email":"gopher@example.com","active":true,"roles":["user"]}`, 4)
+
+	serve := func(opt httpgzip.FileServerOptions) *httptest.ResponseRecorder {
+		fs := httpgzip.NewServer(http.Dir("."), opt)
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/users.json", nil)
+		req.Header.Set("Accept-Encoding", "deflate")
+		fs.ServeContent(rr, req, "users.json", time.Time{}, "", strings.NewReader(response))
+		return rr
+	}
+
+	rr := serve(httpgzip.FileServerOptions{DeflateDictionary: dict})
+	if got, want := rr.Header().Get("Content-Encoding"), "deflate"; got != want {
+		t.Fatalf("got Content-Encoding %q, want %q", got, want)
+	}
+	zr, err := zlib.NewReaderDict(rr.Body, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != response {
+		t.Errorf("got decompressed %q, want %q", got, response)
+	}
+
+	rr = serve(httpgzip.FileServerOptions{})
+	if got := rr.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("without DeflateDictionary: got Content-Encoding %q, want none", got)
+	}
+}
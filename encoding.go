@@ -0,0 +1,167 @@
+package httpgzip
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Encoding is a content-coding that ServeContent can encode responses with.
+type Encoding interface {
+	// Name returns the name of the content-coding, as used in
+	// Accept-Encoding and Content-Encoding headers, e.g., "gzip".
+	Name() string
+
+	// NewWriter returns a writer that compresses data written to it,
+	// and writes the compressed data to w. Closing it flushes any pending data,
+	// but doesn't close w. NewWriter returns nil if the encoding doesn't
+	// support compression on the fly.
+	NewWriter(w io.Writer) io.WriteCloser
+
+	// FindPrecompressed returns the path of a precompressed variant
+	// of the file at fpath, such as fpath + ".gz". The variant is served
+	// if it exists. FindPrecompressed returns "" if the encoding doesn't
+	// support precompressed variants.
+	FindPrecompressed(fpath string) string
+}
+
+// DynamicEncoding is implemented by encodings that report whether they
+// support compression on the fly, without creating a writer. Whether other
+// encodings do is checked by calling NewWriter, and closing its result.
+type DynamicEncoding interface {
+	Encoding
+
+	// CompressesOnTheFly reports whether NewWriter returns a non-nil writer.
+	CompressesOnTheFly() bool
+}
+
+// RegisterEncoding registers enc, making it available to ServeContent.
+// If an encoding with the same name, regardless of case, is already registered,
+// enc replaces it.
+//
+// When a client accepts multiple encodings equally, the one registered first
+// is used. Brotli ("br", see FileServerOptions.DynamicBrotli), gzip and Zstandard
+// ("zstd", see FileServerOptions.ZstdLevel) are registered by default, in that order.
+func RegisterEncoding(enc Encoding) {
+	encodings.Lock()
+	defer encodings.Unlock()
+	for i, e := range encodings.list {
+		if strings.EqualFold(e.Name(), enc.Name()) {
+			encodings.list[i] = enc
+			return
+		}
+	}
+	encodings.list = append(encodings.list, enc)
+}
+
+// encodings are the registered encodings, in order of registration.
+var encodings = struct {
+	sync.RWMutex
+	list []Encoding
+}{
+	list: []Encoding{brotliEncoding{}, gzipEncoding{}, zstdEncoding{}},
+}
+
+// registeredEncodings returns a snapshot of the registered encodings.
+func registeredEncodings() []Encoding {
+	encodings.RLock()
+	defer encodings.RUnlock()
+	return append([]Encoding(nil), encodings.list...)
+}
+
+// availableEncodings returns the registered encodings, except those
+// disabled via FileServerOptions.DisabledEncodings, with the "deflate"
+// encoding replaced if FileServerOptions.DeflateDictionary is set.
+func (fs *Server) availableEncodings() []Encoding {
+	encs := registeredEncodings()
+	if fs.opt.DeflateDictionary != nil {
+		encs = withEncoding(encs, DeflateDictEncoding(fs.opt.DeflateDictionary))
+	}
+	if len(fs.opt.DisabledEncodings) == 0 {
+		return encs
+	}
+	available := encs[:0]
+	for _, enc := range encs {
+		if !isNamed(enc, fs.opt.DisabledEncodings) {
+			available = append(available, enc)
+		}
+	}
+	return available
+}
+
+// isNamed reports whether the name of enc is one of names.
+// Content-codings are case-insensitive, so names are matched regardless of case.
+func isNamed(enc Encoding, names []string) bool {
+	for _, name := range names {
+		if strings.EqualFold(enc.Name(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// withEncoding returns encs with enc replacing the encoding of the same name,
+// or appended if there's none.
+func withEncoding(encs []Encoding, enc Encoding) []Encoding {
+	for i, e := range encs {
+		if strings.EqualFold(e.Name(), enc.Name()) {
+			encs[i] = enc
+			return encs
+		}
+	}
+	return append(encs, enc)
+}
+
+// gzipEncoding is the gzip content-coding.
+//
+// Writers returned by NewWriter aren't pooled, since they're handed to callers
+// that may not close them exactly once. File servers and CompressWriter
+// use pooled writers instead.
+type gzipEncoding struct{}
+
+func (gzipEncoding) Name() string                          { return "gzip" }
+func (gzipEncoding) NewWriter(w io.Writer) io.WriteCloser  { return gzip.NewWriter(w) }
+func (gzipEncoding) FindPrecompressed(fpath string) string { return fpath + ".gz" }
+func (gzipEncoding) CompressesOnTheFly() bool              { return true }
+
+// brotliEncoding is the Brotli content-coding. It's served from precompressed
+// variants, and compressed on the fly only if enabled via FileServerOptions.DynamicBrotli,
+// since compressing Brotli on the fly is not performant.
+type brotliEncoding struct{}
+
+func (brotliEncoding) Name() string                          { return "br" }
+func (brotliEncoding) NewWriter(w io.Writer) io.WriteCloser  { return nil }
+func (brotliEncoding) FindPrecompressed(fpath string) string { return fpath + ".br" }
+func (brotliEncoding) CompressesOnTheFly() bool              { return false }
+
+// zstdEncoding is the Zstandard content-coding. It's served from precompressed
+// variants, and compressed on the fly only if enabled via FileServerOptions.ZstdLevel,
+// since zstd encoders are expensive to create and are pooled per file server.
+type zstdEncoding struct{}
+
+func (zstdEncoding) Name() string                          { return "zstd" }
+func (zstdEncoding) NewWriter(w io.Writer) io.WriteCloser  { return nil }
+func (zstdEncoding) FindPrecompressed(fpath string) string { return fpath + ".zst" }
+func (zstdEncoding) CompressesOnTheFly() bool              { return false }
+
+// preferEncodings returns encs ordered so that encodings named in pref
+// come first, in the order of pref, followed by the rest in their original order.
+// Names in pref are matched regardless of case.
+func preferEncodings(encs []Encoding, pref []string) []Encoding {
+	if len(pref) == 0 {
+		return encs
+	}
+	rank := func(enc Encoding) int {
+		for i, name := range pref {
+			if strings.EqualFold(enc.Name(), name) {
+				return i
+			}
+		}
+		return len(pref)
+	}
+	sorted := append([]Encoding(nil), encs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return rank(sorted[i]) < rank(sorted[j]) })
+	return sorted
+}
@@ -0,0 +1,114 @@
+package httpgzip_test
+
+import (
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/shurcooL/httpgzip"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+func init() {
+	httpgzip.RegisterEncoding(testDeflateEncoding{})
+}
+
+// testDeflateEncoding is a custom encoding registered by tests.
+type testDeflateEncoding struct{}
+
+func (testDeflateEncoding) Name() string { return "x-test-deflate" }
+func (testDeflateEncoding) NewWriter(w io.Writer) io.WriteCloser {
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return fw
+}
+func (testDeflateEncoding) FindPrecompressed(fpath string) string { return fpath + ".xtd" }
+
+// Test that ServeContent negotiates registered custom encodings.
+func TestServeContentRegisteredEncoding(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":     compressibleText,
+		"bar.txt":     compressibleText,
+		"bar.txt.xtd": "precompressed",
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{})
+
+	rr := serveGet(h, "/foo.txt", "gzip;q=0.5, x-test-deflate")
+	if got, want := rr.Header().Get("Content-Encoding"), "x-test-deflate"; got != want {
+		t.Fatalf("got Content-Encoding %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadAll(flate.NewReader(rr.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != compressibleText {
+		t.Errorf("got decompressed body %q, want original content", b)
+	}
+
+	rr = serveGet(h, "/bar.txt", "x-test-deflate")
+	if got, want := rr.Header().Get("Content-Encoding"), "x-test-deflate"; got != want {
+		t.Errorf("got Content-Encoding %q, want %q", got, want)
+	}
+	if got, want := rr.Body.String(), "precompressed"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+
+	rr = serveGet(h, "/foo.txt", "gzip, x-test-deflate;q=0.5")
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Errorf("got Content-Encoding %q, want %q", got, want)
+	}
+}
+
+// countingEncoding is an encoding that counts the writers it creates,
+// and how many of them are closed.
+type countingEncoding struct {
+	testDeflateEncoding
+	writers, closes *int
+}
+
+func (e countingEncoding) NewWriter(w io.Writer) io.WriteCloser {
+	*e.writers++
+	return countingWriter{WriteCloser: e.testDeflateEncoding.NewWriter(w), closes: e.closes}
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	closes *int
+}
+
+func (w countingWriter) Close() error {
+	*w.closes++
+	return w.WriteCloser.Close()
+}
+
+// dynamicCountingEncoding is a countingEncoding that implements httpgzip.DynamicEncoding.
+type dynamicCountingEncoding struct{ countingEncoding }
+
+func (dynamicCountingEncoding) CompressesOnTheFly() bool { return true }
+
+// Test that writers created to check whether an encoding supports
+// compression on the fly are closed, and that they're not created
+// for encodings that implement httpgzip.DynamicEncoding.
+func TestServeContentDynamicEncodingWriters(t *testing.T) {
+	defer httpgzip.RegisterEncoding(testDeflateEncoding{})
+	fs := httpfs.New(mapfs.New(map[string]string{"foo.txt": compressibleText}))
+	for _, dynamic := range []bool{false, true} {
+		var writers, closes int
+		var enc httpgzip.Encoding = countingEncoding{writers: &writers, closes: &closes}
+		if dynamic {
+			enc = dynamicCountingEncoding{countingEncoding{writers: &writers, closes: &closes}}
+		}
+		httpgzip.RegisterEncoding(enc)
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{})
+		if got, want := serveGet(h, "/foo.txt", "x-test-deflate").Header().Get("Content-Encoding"), "x-test-deflate"; got != want {
+			t.Errorf("DynamicEncoding %v: got Content-Encoding %q, want %q", dynamic, got, want)
+		}
+		if writers != closes {
+			t.Errorf("DynamicEncoding %v: created %d writers, but closed %d", dynamic, writers, closes)
+		}
+		if dynamic && writers != 1 {
+			t.Errorf("DynamicEncoding %v: created %d writers, want 1", dynamic, writers)
+		}
+	}
+}
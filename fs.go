@@ -1,32 +1,129 @@
 package httpgzip
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"html"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
 	pathpkg "path"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // FileServer returns a handler that serves HTTP requests
 // with the contents of the file system rooted at root.
 // Additional optional behaviors can be controlled via opt.
+// root can be any http.FileSystem, such as http.Dir or http.FS, so it's
+// a drop-in replacement for http.FileServer. Precompressed variants of files,
+// such as "foo.txt.gz", are opened through root, and files it opens
+// that implement GzipByter are served using their gzip bytes directly.
+//
+// The returned handler is a *Server. Use NewServer to access its methods,
+// such as ServeContent.
 func FileServer(root http.FileSystem, opt FileServerOptions) http.Handler {
+	return NewServer(root, opt)
+}
+
+// NewServer returns a file server that serves the file system rooted at root,
+// as described by FileServer, with options opt. Its methods, such as
+// ServeContent, can be used to serve content with the same options.
+//
+// Options that aren't supported by this build of the package, as reported
+// by opt.Validate, are logged and ignored.
+func NewServer(root http.FileSystem, opt FileServerOptions) *Server {
+	if err := opt.Validate(); err != nil {
+		log.Printf("%v; ignoring it", err)
+		opt.DynamicBrotli = opt.DynamicBrotli && dynamicBrotliSupported
+		if !dynamicZstdSupported {
+			opt.ZstdLevel = 0
+		}
+	}
 	if opt.ServeError == nil {
 		opt.ServeError = defaults.ServeError
 	}
-	return &fileServer{root: root, opt: opt}
+	if opt.ErrorHandler == nil {
+		opt.ErrorHandler = defaults.ErrorHandler
+	}
+	if opt.IncompressibleTypes == nil {
+		opt.IncompressibleTypes = defaults.IncompressibleTypes
+	}
+	if opt.GzipLevels == nil {
+		opt.GzipLevels = defaults.GzipLevels
+	}
+	if opt.BrotliSuffixes == nil {
+		opt.BrotliSuffixes = defaults.BrotliSuffixes
+	}
+	if opt.MaxReaderBufferSize == 0 {
+		opt.MaxReaderBufferSize = defaults.MaxReaderBufferSize
+	}
+	if opt.AcceptEncodingHeader == "" {
+		opt.AcceptEncodingHeader = defaults.AcceptEncodingHeader
+	}
+	fs := &Server{root: root, opt: opt}
+	if opt.ZstdLevel != 0 {
+		fs.zstdEncoders = newZstdEncoderPool(opt.ZstdLevel)
+	}
+	if opt.PrecompressedCacheSize > 0 {
+		fs.precompressed = newPrecompressedCache(opt.PrecompressedCacheSize)
+	}
+	if opt.MaxConcurrentCompressions > 0 {
+		fs.compressions = make(chan struct{}, opt.MaxConcurrentCompressions)
+	}
+	return fs
+}
+
+// DefaultFileServer is the file server used by the package-level ServeContent,
+// ServeContentError and ServeReader functions. It uses default options.
+// Its root file system is empty, so that content isn't served with
+// precompressed variants found in the current directory, or wherever fpath
+// happens to point; content is always compressed on the fly. Use NewServer
+// to serve files, and content with their precompressed variants.
+var DefaultFileServer = NewServer(emptyFS{}, FileServerOptions{})
+
+// emptyFS is a file system without any files.
+type emptyFS struct{}
+
+func (emptyFS) Open(string) (http.File, error) { return nil, os.ErrNotExist }
+
+// Validate returns an error if opt sets options that aren't supported
+// by this build of the package, such as DynamicBrotli without the brotli
+// build tag, or ZstdLevel without the zstd build tag.
+func (opt FileServerOptions) Validate() error {
+	if opt.DynamicBrotli && !dynamicBrotliSupported {
+		return errors.New("httpgzip: FileServerOptions.DynamicBrotli requires building with the brotli build tag")
+	}
+	if opt.ZstdLevel != 0 && !dynamicZstdSupported {
+		return errors.New("httpgzip: FileServerOptions.ZstdLevel requires building with the zstd build tag")
+	}
+	return nil
 }
 
 var defaults = FileServerOptions{
-	ServeError: NonSpecific,
+	ServeError:           NonSpecific,
+	ErrorHandler:         serveContentError,
+	BrotliSuffixes:       []string{".br"},
+	MaxReaderBufferSize:  10 << 20,
+	AcceptEncodingHeader: "Accept-Encoding",
+	GzipLevels:           map[string]int{"application/wasm": gzip.BestCompression},
+	IncompressibleTypes: []string{
+		"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif",
+		"video/*", "audio/*", "font/woff", "font/woff2",
+		"application/zip", "application/gzip", "application/x-gzip",
+		"application/zstd", "application/x-7z-compressed", "application/x-rar-compressed",
+	},
 }
 
-// FileServerOptions specifies options for FileServer.
+// FileServerOptions specifies options for FileServer and NewServer.
 type FileServerOptions struct {
 	// DisableDirListing controls whether a directory listing is shown for directories.
 	DisableDirListing bool
@@ -34,11 +131,324 @@ type FileServerOptions struct {
 	// IndexHTML controls special handling of "index.html" file.
 	IndexHTML bool
 
+	// EncodingPreference lists names of encodings in order of preference.
+	// It's used to choose among encodings that a request accepts equally,
+	// such as "br" and "gzip" for "Accept-Encoding: br, gzip".
+	// Encodings not listed are least preferred, in order of registration.
+	// If nil, encodings are preferred in order of registration,
+	// which is Brotli, then gzip, for the default encodings.
+	// Here and in the Disabled options below, names are matched regardless of case.
+	EncodingPreference []string
+
+	// CompressOnMissingAcceptEncoding controls whether requests without
+	// an Accept-Encoding header are served gzip compressed content.
+	// Such requests accept any encoding, but it's safest to assume
+	// they're from clients that don't support any, which is done by default.
+	CompressOnMissingAcceptEncoding bool
+
+	// AcceptEncodingHeader is the name of the request header that
+	// encodings are negotiated from, such as "X-Forwarded-Accept-Encoding"
+	// when a CDN in front of the server forwards the client's Accept-Encoding
+	// header in it. Encoded responses vary by it. If empty, "Accept-Encoding" is used.
+	AcceptEncodingHeader string
+
+	// DisabledEncodings lists names of registered encodings that aren't used,
+	// such as "br" when a proxy in front of the server compresses responses itself.
+	// Disabled encodings are never negotiated, even if precompressed
+	// variants of files encoded with them exist.
+	DisabledEncodings []string
+
+	// DisabledPrecompressed lists names of encodings whose precompressed
+	// variants of files aren't looked for, such as "br" when a CDN in front
+	// of the server already serves Brotli. The file system isn't checked
+	// for such variants at all. The encodings are still used to compress
+	// on the fly, if supported.
+	DisabledPrecompressed []string
+
+	// DisabledDynamic lists names of encodings that content isn't
+	// compressed with on the fly, such as "gzip" to only serve
+	// precompressed gzip variants. Precompressed variants are still served.
+	DisabledDynamic []string
+
+	// DeflateDictionary, if non-nil, is a preset dictionary that responses
+	// are compressed with using the "deflate" content-coding, as with
+	// DeflateDictEncoding. It's used instead of any registered "deflate"
+	// encoding, and only by this file server.
+	//
+	// Responses compressed with a dictionary are non-standard: only clients
+	// that have the same dictionary can decompress them, and browsers can't.
+	// So it should only be set for servers whose clients are under the same control,
+	// such as internal APIs serving many small, similar JSON responses.
+	DeflateDictionary []byte
+
+	// PreferServerPreference controls whether the server's order of preference,
+	// as given by EncodingPreference, takes precedence over quality values
+	// in the request. Encodings the request doesn't accept (with q=0) are
+	// still never used. Preferring the server's order can minimize bandwidth,
+	// such as by always preferring Brotli, while respecting the client's
+	// quality values lets it choose encodings that are faster for it to decode.
+	PreferServerPreference bool
+
+	// BrotliSuffixes are the file name suffixes of precompressed Brotli variants
+	// of files, in order of preference. The first variant that exists is served.
+	// If nil, []string{".br"} is used.
+	BrotliSuffixes []string
+
+	// VerifyPrecompressed controls whether precompressed gzip variants of files
+	// are checked to begin with the gzip header magic bytes before being served.
+	// Variants that don't are logged and skipped, so that the original file
+	// is served instead, compressed on the fly if possible.
+	VerifyPrecompressed bool
+
+	// VerifyPrecompressedIntegrity is like VerifyPrecompressed, except
+	// precompressed gzip variants are also decompressed in full, to check that
+	// their CRC-32 and size trailers are intact, and that they decompress to
+	// the size of the original file. Decompression stops once the variant
+	// decompresses to more than that. This is expensive, so variants are only
+	// checked once while their modification time stays the same.
+	VerifyPrecompressedIntegrity bool
+
+	// BufferPrecompressedSize is the maximum size, in bytes, of precompressed
+	// variants of files that are read into memory in full before being served.
+	// Otherwise, a variant that fails to read partway, such as due to a disk
+	// error or being truncated after it's opened, results in a partial response,
+	// since the status and headers are already written. Variants that fail
+	// to read into memory are logged and skipped, so that the original file
+	// is served instead. If zero, precompressed variants aren't buffered.
+	BufferPrecompressedSize int64
+
+	// IncompressibleTypes lists content types that aren't worth attempting
+	// to compress on the fly, such as already compressed image formats.
+	// Entries are media types, such as "image/png", or types with a "*"
+	// subtype wildcard, such as "video/*". The effective Content-Type of
+	// the response is used, whether it was set by the caller or detected.
+	// Precompressed variants of files are served regardless of their type.
+	// If nil, a default list of common compressed formats is used.
+	// Set to an empty non-nil slice to attempt compressing all types.
+	IncompressibleTypes []string
+
+	// CompressibleTypesOnly, if not nil, lists the only content types that
+	// are compressed on the fly, in the same format as IncompressibleTypes.
+	// Content of any other type is served as is, regardless of its size
+	// or AlwaysCompressTypes. It's a stricter alternative to IncompressibleTypes,
+	// which is ignored when CompressibleTypesOnly is set. Content of listed
+	// types is still only compressed according to MinSize and MinSavings.
+	// Precompressed variants of files are served regardless of their type.
+	CompressibleTypesOnly []string
+
+	// MinSize is the minimum size of content, in bytes, for it to be
+	// compressed on the fly. If zero, content of any size is compressed.
+	MinSize int64
+
+	// AlwaysCompressTypes lists content types that are compressed on the fly
+	// regardless of MinSize, such as highly compressible small JSON responses.
+	// Entries have the same format as IncompressibleTypes. Compressed output
+	// is still only served if it's smaller, as determined by MinSavings.
+	AlwaysCompressTypes []string
+
+	// GzipLevels maps content types to the gzip compression level, such as
+	// gzip.BestCompression, that content of that type is compressed with
+	// on the fly. Keys have the same format as IncompressibleTypes, and
+	// media types take precedence over wildcards. Types not listed use
+	// gzip.DefaultCompression. If nil, application/wasm uses gzip.BestCompression,
+	// since WebAssembly modules compress well and are sensitive to download size.
+	GzipLevels map[string]int
+
+	// DynamicBrotli controls whether content is compressed with Brotli
+	// on the fly for requests that prefer it. It requires building with
+	// the brotli build tag, which adds a dependency on a Brotli encoder;
+	// it's ignored otherwise (see Validate). Precompressed Brotli variants
+	// are served regardless.
+	DynamicBrotli bool
+
+	// DynamicBrotliTypes lists content types that are compressed with Brotli
+	// on the fly when DynamicBrotli is set, such as "text/html" and
+	// "application/json", where the savings over gzip are largest.
+	// Content of other types is compressed with the next preferred encoding,
+	// such as gzip. Entries have the same format as IncompressibleTypes.
+	// If nil, content of any type is compressed with Brotli.
+	DynamicBrotliTypes []string
+
+	// ZstdLevel is the Zstandard compression level, as in the zstd command line
+	// tool, that content is compressed with on the fly for requests that prefer
+	// zstd. If zero, zstd is only served from precompressed ".zst" variants.
+	// It requires building with the zstd build tag, which adds a dependency
+	// on a zstd encoder; it's ignored otherwise (see Validate).
+	ZstdLevel int
+
+	// MinSavings is the minimum fraction of the original size that on the fly
+	// compression, with any encoding, must save for the compressed result to be served,
+	// e.g., 0.1 to require at least 10% savings. If zero, any reduction
+	// in size is considered worth it.
+	MinSavings float64
+
+	// MaxCompressBytes is the maximum size of content, in bytes, that is
+	// compressed on the fly. Larger content is served without compression,
+	// which bounds the memory used to buffer compressed output.
+	// If zero, there is no limit.
+	MaxCompressBytes int64
+
+	// MaxCompressTime is the maximum time spent compressing
+	// a single response on the fly. If compression takes longer, it's
+	// abandoned and the content is served without compression.
+	// If zero, there is no limit. A compression shared by concurrent
+	// requests for the same file isn't abandoned when the request that
+	// started it is canceled, so it's only limited by MaxCompressTime.
+	MaxCompressTime time.Duration
+
+	// DetectGzipContent controls whether content that is already a gzip stream,
+	// as detected by its leading magic bytes, is served as is with
+	// "Content-Encoding: gzip", rather than being compressed again.
+	// Such content is decompressed for requests that don't accept gzip,
+	// into memory of up to MaxReaderBufferSize bytes. Content that
+	// decompresses to more than that fails to be served with a ContentError.
+	DetectGzipContent bool
+
+	// DisableSniffing controls whether the content type of content is detected
+	// from its leading bytes, when it's not set by the caller and can't be
+	// determined from the file extension. If set, such content is served as
+	// "application/octet-stream" without compression, and isn't read to detect it.
+	// It suits servers where every file has a known extension, avoiding both
+	// the cost of sniffing and its guesses, such as text/plain for JSON.
+	// Sniffing is enabled by default.
+	DisableSniffing bool
+
+	// DefaultContentType is the content type of content whose type isn't set
+	// by the caller, and can't be determined from the file extension or
+	// by sniffing, such as "text/plain; charset=utf-8" for extensionless
+	// text files. Sniffing is considered to fail if it yields
+	// "application/octet-stream". If empty, such content is served
+	// as "application/octet-stream".
+	DefaultContentType string
+
+	// SniffSize is the number of leading bytes of content that are read
+	// to detect its content type, when it's not set by the caller and can't
+	// be determined from the file extension. If zero, or larger than 512,
+	// 512 is used, which is the most that http.DetectContentType considers.
+	SniffSize int
+
+	// DisableDynamicRanges controls whether range requests are supported
+	// for responses compressed on the fly. If set, such responses advertise
+	// "Accept-Ranges: none", and are served in full for range requests,
+	// since the compressed representation isn't guaranteed to be stable.
+	// Precompressed and uncompressed responses support range requests regardless.
+	DisableDynamicRanges bool
+
+	// PrecompressedCacheSize is the maximum number of lookups of precompressed
+	// variants of files that are cached, so that the file system isn't
+	// checked for variants on every request. Cached lookups are only used
+	// for files with the same modification time as when they were looked up,
+	// so they're invalidated when files change, and aren't cached for files
+	// without a modification time. If zero, lookups aren't cached.
+	PrecompressedCacheSize int
+
+	// PrecompressCacheDir is a directory where output of on the fly
+	// compression is persisted, so that later requests for the same file
+	// are served from it as precompressed variants. Variants are stored
+	// at the path of the file within the directory, and are only used while
+	// the file has the same modification time as when they were written.
+	// Failures to write variants are ignored. If empty, output isn't persisted.
+	PrecompressCacheDir string
+
+	// MaxReaderBufferSize is the maximum size of content, in bytes, that
+	// ServeReader reads into memory in order to serve it with ServeContent.
+	// Larger content is streamed without compression. It also applies to
+	// files opened from the root file system that can't seek: larger ones
+	// are streamed the same way, and larger precompressed variants are skipped.
+	// If zero, 10 MB is used.
+	MaxReaderBufferSize int64
+
+	// MaxConcurrentCompressions is the maximum number of responses that are
+	// compressed on the fly at the same time. When the limit is reached,
+	// further responses are served without compression, rather than waiting.
+	// It bounds the CPU used for compression under load.
+	// If zero, there is no limit.
+	MaxConcurrentCompressions int
+
+	// CompressGate, if not nil, is called before compressing content on the fly.
+	// If it returns false, the content is served without compression.
+	// It can be used to skip compression when the server is under heavy load,
+	// such as by consulting the load average or a token bucket.
+	// Serving precompressed variants isn't affected.
+	CompressGate func() bool
+
+	// CompressionFilter, if not nil, is called for each request before
+	// an encoding is chosen. If it returns false, content is served without
+	// compression, and precompressed variants aren't used. It can be used to
+	// disable compression for clients known to mishandle it, such as by
+	// User-Agent. Responses whose encoding depends on such request headers
+	// should list them in a "Vary" header, which is up to the caller.
+	CompressionFilter func(req *http.Request) bool
+
+	// ComputeETag controls whether a strong "ETag" header, derived from a hash
+	// of the served bytes, is set on responses that don't already have one.
+	// Since the hash is of the encoded bytes, each encoding of a file gets
+	// a distinct ETag, and conditional requests such as "If-Range" are only
+	// satisfied by the validator of the negotiated representation.
+	// It requires reading content an extra time, so it's best suited
+	// for small or immutable assets.
+	ComputeETag bool
+
+	// GzipHeader controls whether gzip output compressed on the fly carries
+	// the name and modification time of the file in its header.
+	// It's off by default, so that compressing the same content always
+	// produces identical output, which matters to caches that hash response bodies.
+	GzipHeader bool
+
+	// DebugHeader controls whether an "X-Compression" header describing
+	// how the response was encoded is added to responses. Its value is one of
+	// "br-precompressed", "gzip-precompressed", "gzip-dynamic" or "identity".
+	// An "X-Compression-Debug" header describing the negotiation is added too,
+	// such as "chosen=br, source=precompressed, accepted=[br,gzip], offered=[br,gzip]".
+	// It's meant for testing and debugging, and shouldn't be enabled in production.
+	DebugHeader bool
+
+	// NoTransform controls whether the "no-transform" directive is added to
+	// the "Cache-Control" header of responses that ServeContent encodes, so that
+	// intermediaries such as proxies don't alter their encoding. It's appended
+	// to any "Cache-Control" header already set. Responses that aren't encoded
+	// are left alone.
+	NoTransform bool
+
+	// CompressedByHeader controls whether an "X-Compressed-By" header naming
+	// the encoding, such as "httpgzip/gzip", is added to responses that
+	// ServeContent encodes, whether precompressed or compressed on the fly.
+	// It distinguishes them from responses encoded elsewhere, such as
+	// by an upstream server or proxy. It can be removed from individual
+	// responses via ServeHook.
+	CompressedByHeader bool
+
+	// ServeHook, if not nil, is called by ServeContent right before the response
+	// is served by http.ServeContent, with the name of the content-coding
+	// the response is encoded with, or "identity" if it isn't encoded.
+	// For content served as is because its "Content-Encoding" header was
+	// already set, that's the comma separated list of codings in the header.
+	// By then, the "Content-Encoding" and "Vary" headers have been set,
+	// and nothing has been written to w, so ServeHook can inspect
+	// or add response headers, such as integrity hashes. It's not called
+	// when ServeContent fails with an error.
+	ServeHook func(w http.ResponseWriter, req *http.Request, encoding string)
+
+	// AbortHook, if not nil, is called by ServeContent after a response
+	// couldn't be written in full, such as because the client disconnected
+	// partway, with the encoding as given to ServeHook and the first error
+	// writing the response. Such responses are counted in EncodingStats.Aborted.
+	AbortHook func(req *http.Request, encoding string, err error)
+
 	// ServeError is used to serve errors coming from underlying file system.
 	// If called, it's guaranteed to be before anything has been written
 	// to w by FileServer, so it's safe to use http.Error.
 	// If nil, then NonSpecific is used.
 	ServeError func(w http.ResponseWriter, req *http.Request, err error)
+
+	// ErrorHandler is used by ServeContent to serve internal errors that
+	// occur while serving content, such as content that can't be seeked.
+	// err is of type *ContentError. If called, it's guaranteed to be
+	// before anything has been written to w by ServeContent, though some
+	// response headers may have been set. It can be used to serve
+	// structured error bodies, such as JSON for APIs. If nil, a plain text
+	// 500 Internal Server Error is served.
+	ErrorHandler func(w http.ResponseWriter, req *http.Request, err error)
 }
 
 var (
@@ -73,12 +483,72 @@ var (
 	}
 )
 
-type fileServer struct {
+// Server is a file server that applies compression, returned by NewServer.
+// It's safe for concurrent use.
+type Server struct {
 	root http.FileSystem
 	opt  FileServerOptions
+
+	// compressions is a semaphore limiting on the fly compressions,
+	// or nil if there's no limit.
+	compressions chan struct{}
+
+	// zstdEncoders is a pool of *zstd.Encoder used to compress on the fly,
+	// or nil if that's disabled.
+	zstdEncoders *sync.Pool
+
+	// inflight coalesces concurrent compressions of the same content.
+	inflight compressGroup
+
+	// precompressed caches lookups of precompressed variants,
+	// or is nil if that's disabled.
+	precompressed *precompressedCache
+
+	stats fileServerStats
+
+	// verified holds the modification times of precompressed variants,
+	// keyed by precompressedKey, whose integrity has been verified.
+	verified sync.Map
+
+	// disabled is set while compression is disabled via SetEnabled.
+	disabled atomic.Bool
+}
+
+// SetEnabled enables or disables compression at run time. While disabled,
+// ServeContent serves all content as is, just like http.ServeContent.
+// Compression is enabled initially. It's safe to call concurrently with
+// requests being served.
+func (fs *Server) SetEnabled(enabled bool) {
+	fs.disabled.Store(!enabled)
 }
 
-func (fs *fileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+// WithRoot returns a file server that serves the file system rooted at root,
+// with the same options as fs, such as for serving multiple tenants alike.
+//
+// The returned file server shares the limit on concurrent compressions of fs
+// (see FileServerOptions.MaxConcurrentCompressions), so that it applies
+// across both, and its pool of Zstandard encoders. State that depends on
+// the root isn't shared: cached lookups of precompressed variants and
+// verifications of their integrity start out empty, as do its Stats.
+// FileServerOptions.PrecompressCacheDir isn't used by it, since variants
+// there are stored at the paths of files, which could collide across roots.
+// It's enabled or disabled (see SetEnabled) like fs, and independently of it afterwards.
+func (fs *Server) WithRoot(root http.FileSystem) *Server {
+	c := &Server{
+		root:         root,
+		opt:          fs.opt,
+		compressions: fs.compressions,
+		zstdEncoders: fs.zstdEncoders,
+	}
+	c.opt.PrecompressCacheDir = ""
+	if c.opt.PrecompressedCacheSize > 0 {
+		c.precompressed = newPrecompressedCache(c.opt.PrecompressedCacheSize)
+	}
+	c.disabled.Store(fs.disabled.Load())
+	return c
+}
+
+func (fs *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "GET" {
 		w.Header().Set("Allow", "GET")
 		http.Error(w, "405 Method Not Allowed\n\nmethod should be GET", http.StatusMethodNotAllowed)
@@ -86,13 +556,35 @@ func (fs *fileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Already cleaned by net/http.cleanPath, but caller can be some middleware.
-	path := pathpkg.Clean("/" + req.URL.Path)
+	serveFile(fs, w, req, pathpkg.Clean("/"+req.URL.Path), true)
+}
+
+// ServeFile is like http.ServeFile, except it serves the file at fpath
+// in the file system of fs with ServeContent, which applies compression
+// and uses precompressed variants of the file if available.
+// Errors opening the file are served via FileServerOptions.ServeError,
+// and directories are handled the same way as by FileServer.
+// The file's modification time is used for Last-Modified, and any files
+// ServeFile opens are closed before it returns.
+//
+// Like http.ServeFile, it redirects requests whose URL path ends in
+// "/index.html" if FileServerOptions.IndexHTML is set, but since fpath
+// needn't correspond to the URL path, it doesn't redirect to canonical
+// paths with or without a trailing slash.
+func (fs *Server) ServeFile(w http.ResponseWriter, req *http.Request, fpath string) {
+	serveFile(fs, w, req, pathpkg.Clean("/"+fpath), false)
+}
 
+// serveFile serves the file at path, which must be clean and absolute.
+// Redirects are relative to req.URL.Path. If redirect is true, requests
+// are redirected to canonical paths with or without a trailing slash,
+// which only makes sense if path corresponds to req.URL.Path.
+func serveFile(fs *Server, w http.ResponseWriter, req *http.Request, path string, redirect bool) {
 	if fs.opt.IndexHTML {
 		// Redirect .../index.html to .../.
 		// Can't use Redirect() because that would make the path absolute,
 		// which would be a problem running under StripPrefix.
-		if strings.HasSuffix(path, "/index.html") {
+		if strings.HasSuffix(req.URL.Path, "/index.html") {
 			localRedirect(w, req, ".")
 			return
 		}
@@ -111,13 +603,12 @@ func (fs *fileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Redirect to canonical path: / at end of directory url.
-	url := req.URL.Path
-	if fi.IsDir() {
+	if url := req.URL.Path; redirect && fi.IsDir() {
 		if !strings.HasSuffix(url, "/") && url != "" {
 			localRedirect(w, req, pathpkg.Base(url)+"/")
 			return
 		}
-	} else {
+	} else if redirect {
 		if strings.HasSuffix(url, "/") && url != "/" {
 			localRedirect(w, req, "../"+pathpkg.Base(url))
 			return
@@ -126,6 +617,8 @@ func (fs *fileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	if fs.opt.IndexHTML {
 		// Use contents of index.html for directory, if present.
+		// The path is updated to that of index.html, so that ServeContent
+		// looks for precompressed variants of it.
 		if fi.IsDir() {
 			indexPath := pathpkg.Join(path, "index.html")
 			f0, err := fs.root.Open(indexPath)
@@ -157,9 +650,78 @@ func (fs *fileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	ServeContent(fs, w, req, fi.Name(), fi.ModTime(), path, f)
+	// File systems such as http.FS return files that can't seek if
+	// the underlying files don't support it. ServeReader buffers them,
+	// up to FileServerOptions.MaxReaderBufferSize.
+	if !canSeek(f) {
+		fs.serveReader(w, req, fi.Name(), fi.ModTime(), path, struct{ io.Reader }{f}, true)
+		return
+	}
+	fs.serveContent(w, req, fi.Name(), fi.ModTime(), path, f, true)
+}
+
+// canSeek reports whether f supports seeking.
+func canSeek(f http.File) bool {
+	_, err := f.Seek(0, io.SeekCurrent)
+	return err == nil
+}
+
+// errTooLargeToBuffer is returned by seekableFile for files
+// that are too large to read into memory.
+var errTooLargeToBuffer = errors.New("too large to buffer")
+
+// seekableFile returns f if it supports seeking, or otherwise f with its
+// contents read into memory, so that it does. It returns errTooLargeToBuffer
+// if f has more than max bytes. File systems such as http.FS return files
+// that can't seek if the underlying files don't support it, but seeking
+// is needed to serve them, such as for range requests.
+func seekableFile(f http.File, max int64) (http.File, error) {
+	if canSeek(f) {
+		return f, nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(f, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, errTooLargeToBuffer
+	}
+	return bufferedFile{File: f, r: bytes.NewReader(b)}, nil
+}
+
+// bufferFile returns f with its contents read into memory if it's
+// no larger than max bytes, so that errors reading it surface before
+// it's served. Otherwise, it returns f as is.
+func bufferFile(f http.File, max int64) (http.File, error) {
+	if _, ok := f.(bufferedFile); ok {
+		return f, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > max {
+		return f, nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(f, fi.Size()+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != fi.Size() {
+		return nil, fmt.Errorf("read %d bytes, want %d", len(b), fi.Size())
+	}
+	return bufferedFile{File: f, r: bytes.NewReader(b)}, nil
 }
 
+// bufferedFile is an http.File whose contents are read from r.
+type bufferedFile struct {
+	http.File
+	r *bytes.Reader
+}
+
+func (f bufferedFile) Read(p []byte) (int, error)                   { return f.r.Read(p) }
+func (f bufferedFile) Seek(offset int64, whence int) (int64, error) { return f.r.Seek(offset, whence) }
+
 func dirList(w http.ResponseWriter, f http.File, root bool) error {
 	dirs, err := f.Readdir(0)
 	if err != nil {
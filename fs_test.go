@@ -1,11 +1,20 @@
 package httpgzip_test
 
 import (
+	"errors"
+	"io/fs"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/shurcooL/httpgzip"
 	"golang.org/x/tools/godoc/vfs/httpfs"
@@ -76,3 +85,504 @@ func TestFileServerImplicitLeadingSlash(t *testing.T) {
 		t.Errorf("got:\n%v\nwant:\n%v\n", got, want)
 	}
 }
+
+// Test that FileServer closes every file it opens exactly once,
+// including precompressed variants opened by ServeContent.
+func TestFileServerClosesFiles(t *testing.T) {
+	for _, acceptEncoding := range []string{"", "gzip"} {
+		fs := &closeCountingFS{
+			FileSystem: httpfs.New(mapfs.New(map[string]string{
+				"foo.txt":    "Hello world",
+				"foo.txt.gz": "\x1f\x8b precompressed",
+			})),
+			closes: make(map[string]int),
+		}
+		req := httptest.NewRequest("GET", "/foo.txt", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		httpgzip.FileServer(fs, httpgzip.FileServerOptions{}).ServeHTTP(httptest.NewRecorder(), req)
+		for name, n := range fs.closes {
+			if n != 1 {
+				t.Errorf("Accept-Encoding %q: %s closed %d times, want 1", acceptEncoding, name, n)
+			}
+		}
+		if acceptEncoding == "gzip" {
+			if _, ok := fs.closes["/foo.txt.gz"]; !ok {
+				t.Errorf("Accept-Encoding %q: precompressed file wasn't opened", acceptEncoding)
+			}
+		}
+	}
+}
+
+// Test that ServeFile redirects based on the request's URL path,
+// not fpath, which needn't correspond to it.
+func TestServeFileRedirects(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"index.html":     "index",
+		"dir/index.html": "dir index",
+		"foo.txt":        "foo",
+	})), httpgzip.FileServerOptions{IndexHTML: true})
+	tests := []struct {
+		urlPath      string
+		fpath        string
+		wantStatus   int
+		wantLocation string
+		wantBody     string
+	}{
+		{urlPath: "/download", fpath: "/index.html", wantStatus: http.StatusOK, wantBody: "index"},
+		{urlPath: "/download", fpath: "/dir", wantStatus: http.StatusOK, wantBody: "dir index"},
+		{urlPath: "/download/", fpath: "/foo.txt", wantStatus: http.StatusOK, wantBody: "foo"},
+		{urlPath: "/docs/index.html", fpath: "/foo.txt", wantStatus: http.StatusMovedPermanently, wantLocation: "."},
+	}
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		fs.ServeFile(rr, httptest.NewRequest("GET", tc.urlPath, nil), tc.fpath)
+		if got := rr.Code; got != tc.wantStatus {
+			t.Errorf("%s for %s: got status %d, want %d", tc.fpath, tc.urlPath, got, tc.wantStatus)
+		}
+		if got := rr.Header().Get("Location"); got != tc.wantLocation {
+			t.Errorf("%s for %s: got Location %q, want %q", tc.fpath, tc.urlPath, got, tc.wantLocation)
+		}
+		if tc.wantBody != "" && rr.Body.String() != tc.wantBody {
+			t.Errorf("%s for %s: got body %q, want %q", tc.fpath, tc.urlPath, rr.Body.String(), tc.wantBody)
+		}
+	}
+}
+
+// Test that ServeFile closes the files it opens.
+func TestServeFileClosesFiles(t *testing.T) {
+	fs := &closeCountingFS{
+		FileSystem: httpfs.New(mapfs.New(map[string]string{
+			"foo.txt":    "Hello world",
+			"foo.txt.gz": "\x1f\x8b precompressed",
+		})),
+		closes: make(map[string]int),
+	}
+	req := httptest.NewRequest("GET", "/download", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	httpgzip.NewServer(fs, httpgzip.FileServerOptions{}).ServeFile(httptest.NewRecorder(), req, "/foo.txt")
+	for _, name := range []string{"/foo.txt", "/foo.txt.gz"} {
+		if n, ok := fs.closes[name]; !ok || n != 1 {
+			t.Errorf("%s closed %d times, want 1", name, n)
+		}
+	}
+}
+
+// Test that precompressed variants are found in an in-memory file system
+// when content is passed to ServeContent directly.
+func TestServeContentInMemoryPrecompressed(t *testing.T) {
+	fs := httpgzip.NewServer(http.FS(fstest.MapFS{
+		"assets/foo.js":    {Data: []byte("console.log('Hello world');")},
+		"assets/foo.js.gz": {Data: []byte("precompressed gzip")},
+	}), httpgzip.FileServerOptions{})
+	req := httptest.NewRequest("GET", "/foo.js", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	fs.ServeContent(rr, req, "foo.js", time.Time{}, "/assets/foo.js", strings.NewReader("console.log('Hello world');"))
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Errorf("got Content-Encoding %q, want %q", got, want)
+	}
+	if got, want := rr.Body.String(), "precompressed gzip"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+}
+
+// Test that FileServerOptions.PrecompressedCacheSize caches lookups of
+// precompressed variants, until the original file changes.
+func TestFileServerPrecompressedCache(t *testing.T) {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	mapFS := fstest.MapFS{
+		"foo.txt": {Data: []byte("Hello world"), ModTime: modTime},
+		"bar.txt": {Data: []byte("Hello world"), ModTime: modTime},
+	}
+	fs := &openCountingFS{FileSystem: http.FS(mapFS), opens: make(map[string]int)}
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{PrecompressedCacheSize: 1})
+
+	for i := 0; i < 3; i++ {
+		serveGet(h, "/foo.txt", "gzip")
+	}
+	if got := fs.opens["/foo.txt.gz"]; got != 1 {
+		t.Errorf("/foo.txt.gz opened %d times, want 1", got)
+	}
+
+	// Changing the file invalidates the cached lookup.
+	mapFS["foo.txt"] = &fstest.MapFile{Data: []byte("Hello world"), ModTime: modTime.Add(time.Hour)}
+	mapFS["foo.txt.gz"] = &fstest.MapFile{Data: []byte("precompressed gzip"), ModTime: modTime.Add(time.Hour)}
+	if got, want := serveGet(h, "/foo.txt", "gzip").Body.String(), "precompressed gzip"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+	if got, want := serveGet(h, "/foo.txt", "gzip").Body.String(), "precompressed gzip"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+
+	// The cache is bounded, so looking up another file evicts the first.
+	serveGet(h, "/bar.txt", "gzip")
+	before := fs.opens["/foo.txt.gz"]
+	serveGet(h, "/foo.txt", "gzip")
+	if got := fs.opens["/foo.txt.gz"]; got != before+1 {
+		t.Errorf("/foo.txt.gz opened %d more times after eviction, want 1", got-before)
+	}
+}
+
+// Test that ServeContent only looks for precompressed variants within
+// the root of the file system, even if fpath refers to outside of it.
+func TestServeContentPrecompressedOutsideRoot(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		fpath     string
+		wantOpens []string
+		wantBody  string
+	}{
+		{fpath: "../../etc/passwd", wantOpens: nil},
+		{fpath: "/sub/../../etc/passwd", wantOpens: nil},
+		{fpath: "foo/../bar.txt", wantOpens: []string{"/bar.txt.br", "/bar.txt.gz"}, wantBody: "precompressed gzip"},
+	}
+	for _, tc := range tests {
+		fs := &openCountingFS{FileSystem: http.FS(fstest.MapFS{
+			"bar.txt.gz": {Data: []byte("precompressed gzip")},
+		}), opens: make(map[string]int)}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		rr := httptest.NewRecorder()
+		httpgzip.NewServer(fs, httpgzip.FileServerOptions{}).ServeContent(rr, req, "passwd", time.Time{}, tc.fpath, strings.NewReader("root:x:0:0"))
+
+		var opens []string
+		for name := range fs.opens {
+			opens = append(opens, name)
+		}
+		sort.Strings(opens)
+		if !reflect.DeepEqual(opens, tc.wantOpens) {
+			t.Errorf("%q: opened %q, want %q", tc.fpath, opens, tc.wantOpens)
+		}
+		if tc.wantBody == "" {
+			tc.wantBody = "root:x:0:0"
+		}
+		if got := rr.Body.String(); got != tc.wantBody {
+			t.Errorf("%q: got body %q, want %q", tc.fpath, got, tc.wantBody)
+		}
+	}
+}
+
+// Test that files from file systems that don't support seeking, and their
+// precompressed variants, are served with range request support.
+func TestFileServerNonSeekableFS(t *testing.T) {
+	h := httpgzip.FileServer(http.FS(nonSeekableFS{fstest.MapFS{
+		"foo.txt":    {Data: []byte(compressibleText)},
+		"foo.txt.gz": {Data: []byte("precompressed gzip")},
+	}}), httpgzip.FileServerOptions{})
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "gzip", want: "precompressed gzip"[2:6]},
+		{acceptEncoding: "identity", want: compressibleText[2:6]},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/foo.txt", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		req.Header.Set("Range", "bytes=2-5")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got, want := rr.Code, http.StatusPartialContent; got != want {
+			t.Errorf("Accept-Encoding %q: got status %d, want %d", tc.acceptEncoding, got, want)
+		}
+		if got := rr.Body.String(); got != tc.want {
+			t.Errorf("Accept-Encoding %q: got body %q, want %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that with FileServerOptions.BufferPrecompressedSize, precompressed
+// variants that fail to read are skipped, rather than served partially.
+func TestFileServerBufferPrecompressed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fsys := failingReadFS{
+		FileSystem: http.FS(fstest.MapFS{
+			"foo.txt":    {Data: []byte(compressibleText)},
+			"foo.txt.gz": {Data: []byte("precompressed gzip")},
+			"foo.txt.br": {Data: []byte("precompressed brotli")},
+		}),
+		failing: "/foo.txt.br",
+	}
+	tests := []struct {
+		opt  httpgzip.FileServerOptions
+		want string
+	}{
+		{opt: httpgzip.FileServerOptions{BufferPrecompressedSize: 1 << 10}, want: "precompressed gzip"},
+		{opt: httpgzip.FileServerOptions{BufferPrecompressedSize: 4}, want: "prec"}, // Too large to buffer, served partially.
+	}
+	for _, tc := range tests {
+		h := httpgzip.FileServer(fsys, tc.opt)
+		req := httptest.NewRequest("GET", "/foo.txt", nil)
+		req.Header.Set("Accept-Encoding", "br, gzip")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got := rr.Body.String(); got != tc.want {
+			t.Errorf("BufferPrecompressedSize %d: got body %q, want %q", tc.opt.BufferPrecompressedSize, got, tc.want)
+		}
+	}
+}
+
+// failingReadFS is an http.FileSystem whose file named failing
+// fails to read after its first 4 bytes.
+type failingReadFS struct {
+	http.FileSystem
+	failing string
+}
+
+func (fs failingReadFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil || name != fs.failing {
+		return f, err
+	}
+	return &failingReadFile{File: f}, nil
+}
+
+type failingReadFile struct {
+	http.File
+	n int
+}
+
+func (f *failingReadFile) Read(p []byte) (int, error) {
+	if f.n >= 4 {
+		return 0, errors.New("read error")
+	}
+	if len(p) > 4-f.n {
+		p = p[:4-f.n]
+	}
+	n, err := f.File.Read(p)
+	f.n += n
+	return n, err
+}
+
+// Test that FileServer serves files opened from its http.FileSystem
+// that implement httpgzip.GzipByter using their gzip bytes.
+func TestFileServerGzipByterFS(t *testing.T) {
+	h := httpgzip.FileServer(gzipByterFS{httpfs.New(mapfs.New(map[string]string{
+		"foo.txt": compressibleText,
+	}))}, httpgzip.FileServerOptions{})
+	rr := serveGet(h, "/foo.txt", "gzip")
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Errorf("got Content-Encoding %q, want %q", got, want)
+	}
+	if got, want := rr.Body.String(), "gzip bytes of /foo.txt"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+}
+
+// gzipByterFS is an http.FileSystem whose files implement httpgzip.GzipByter.
+type gzipByterFS struct{ http.FileSystem }
+
+func (fs gzipByterFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return gzipByterFile{File: f, gzipBytes: []byte("gzip bytes of " + name)}, nil
+}
+
+type gzipByterFile struct {
+	http.File
+	gzipBytes []byte
+}
+
+func (f gzipByterFile) GzipBytes() []byte { return f.gzipBytes }
+
+// Test that file servers created with WithRoot serve their own roots,
+// with the options of the file server they were created from.
+func TestFileServerWithRoot(t *testing.T) {
+	base := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{
+		PrecompressedCacheSize: 10,
+		MinSize:                100,
+		DebugHeader:            true,
+	})
+	tenant1 := base.WithRoot(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"foo.txt.gz": "tenant1 precompressed gzip",
+		"small.txt":  "small",
+	})))
+	tenant2 := base.WithRoot(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":   compressibleText,
+		"small.txt": "small",
+	})))
+	tests := []struct {
+		h    http.Handler
+		path string
+		want string
+	}{
+		{h: tenant1, path: "/foo.txt", want: "gzip-precompressed"},
+		{h: tenant2, path: "/foo.txt", want: "gzip-dynamic"},
+		{h: tenant1, path: "/small.txt", want: "identity"}, // Smaller than MinSize.
+		{h: tenant2, path: "/small.txt", want: "identity"},
+		{h: base, path: "/foo.txt", want: ""}, // Not found.
+	}
+	for i, tc := range tests {
+		rr := serveGet(tc.h, tc.path, "gzip")
+		if got := rr.Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("test %d: %s: got X-Compression %q, want %q", i, tc.path, got, tc.want)
+		}
+	}
+	if got, want := serveGet(tenant1, "/foo.txt", "gzip").Body.String(), "tenant1 precompressed gzip"; got != want {
+		t.Errorf("tenant1: got body %q, want %q", got, want)
+	}
+
+	// Stats are kept separately.
+	if got, want := tenant2.Stats().Requests, map[string]int64{"gzip": 1, "identity": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tenant2: got Requests %v, want %v", got, want)
+	}
+	if got := base.Stats().Requests; len(got) != 0 {
+		t.Errorf("base: got Requests %v, want none", got)
+	}
+
+	// Disabling one doesn't disable the others.
+	tenant1.SetEnabled(false)
+	if got := serveGet(tenant2, "/foo.txt", "gzip").Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("tenant2 after disabling tenant1: got Content-Encoding %q, want %q", got, "gzip")
+	}
+}
+
+// Test that files that can't seek are only read into memory up to
+// FileServerOptions.MaxReaderBufferSize, and streamed as is beyond that.
+func TestFileServerNonSeekableFSLarge(t *testing.T) {
+	small := compressibleText[:200]
+	h := httpgzip.FileServer(http.FS(nonSeekableFS{fstest.MapFS{
+		"small.txt":  {Data: []byte(small)},
+		"large.txt":  {Data: []byte(compressibleText)},
+		"bar.txt":    {Data: []byte(small)},
+		"bar.txt.gz": {Data: []byte(strings.Repeat("precompressed gzip", 100))},
+	}}), httpgzip.FileServerOptions{MaxReaderBufferSize: 1000, DebugHeader: true})
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		path string
+		want string // X-Compression header, if set.
+		body string
+	}{
+		{path: "/small.txt", want: "gzip-dynamic"},
+		{path: "/large.txt", want: "", body: compressibleText},
+		{path: "/bar.txt", want: "gzip-dynamic"}, // Precompressed variant too large to buffer.
+	}
+	for _, tc := range tests {
+		rr := serveGet(h, tc.path, "gzip")
+		if got := rr.Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("%s: got X-Compression %q, want %q", tc.path, got, tc.want)
+		}
+		if tc.body != "" && rr.Body.String() != tc.body {
+			t.Errorf("%s: got body of %d bytes, want %d", tc.path, rr.Body.Len(), len(tc.body))
+		}
+	}
+}
+
+// nonSeekableFS is an fs.FS whose files don't implement io.Seeker.
+type nonSeekableFS struct{ fs fs.FS }
+
+func (fsys nonSeekableFS) Open(name string) (fs.File, error) {
+	f, err := fsys.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ fs.File }{f}, nil
+}
+
+// openCountingFS is an http.FileSystem that counts
+// how many times each file was attempted to be opened.
+type openCountingFS struct {
+	http.FileSystem
+	opens map[string]int // Keyed by file name.
+}
+
+func (fs *openCountingFS) Open(name string) (http.File, error) {
+	fs.opens[name]++
+	return fs.FileSystem.Open(name)
+}
+
+// closeCountingFS is an http.FileSystem that counts
+// how many times each file it opened was closed.
+type closeCountingFS struct {
+	http.FileSystem
+
+	mu     sync.Mutex
+	closes map[string]int // Keyed by file name.
+}
+
+func (fs *closeCountingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.mu.Lock()
+	fs.closes[name] += 0
+	fs.mu.Unlock()
+	return closeCountingFile{File: f, fs: fs, name: name}, nil
+}
+
+type closeCountingFile struct {
+	http.File
+	fs   *closeCountingFS
+	name string
+}
+
+func (f closeCountingFile) Close() error {
+	f.fs.mu.Lock()
+	f.fs.closes[f.name]++
+	f.fs.mu.Unlock()
+	return f.File.Close()
+}
+
+// Test that a precompressed variant of index.html is served for directories.
+func TestFileServerIndexHTMLPrecompressed(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"dir/index.html":    "<p>Hello world</p>",
+		"dir/index.html.gz": "precompressed",
+	}))
+	req := httptest.NewRequest("GET", "/dir/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	httpgzip.FileServer(fs, httpgzip.FileServerOptions{IndexHTML: true}).ServeHTTP(rr, req)
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Errorf("got Content-Encoding %q, want %q", got, want)
+	}
+	if got, want := rr.Header().Get("Content-Type"), "text/html; charset=utf-8"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+	if got, want := rr.Body.String(), "precompressed"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+}
+
+func TestServeFile(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    "Hello world",
+		"bar.txt":    "Hello world",
+		"bar.txt.gz": "precompressed",
+	})), httpgzip.FileServerOptions{})
+	tests := []struct {
+		fpath        string
+		wantStatus   int
+		wantEncoding string
+		wantBody     string
+	}{
+		{fpath: "foo.txt", wantStatus: http.StatusOK, wantBody: "Hello world"},
+		{fpath: "/bar.txt", wantStatus: http.StatusOK, wantEncoding: "gzip", wantBody: "precompressed"},
+		{fpath: "/missing.txt", wantStatus: http.StatusNotFound, wantBody: "404 Not Found\n"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/download", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		fs.ServeFile(rr, req, tc.fpath)
+		if got := rr.Code; got != tc.wantStatus {
+			t.Errorf("%s: got status %d, want %d", tc.fpath, got, tc.wantStatus)
+		}
+		if got := rr.Header().Get("Content-Encoding"); got != tc.wantEncoding {
+			t.Errorf("%s: got Content-Encoding %q, want %q", tc.fpath, got, tc.wantEncoding)
+		}
+		if got := rr.Body.String(); got != tc.wantBody {
+			t.Errorf("%s: got body %q, want %q", tc.fpath, got, tc.wantBody)
+		}
+	}
+}
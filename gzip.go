@@ -3,15 +3,22 @@ package httpgzip
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"mime"
 	"net/http"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
-
-	"golang.org/x/net/http/httpguts"
 )
 
 // GzipByter is implemented by compressed files for
@@ -21,6 +28,16 @@ type GzipByter interface {
 	GzipBytes() []byte
 }
 
+// OriginalSizer is implemented by compressed files that know
+// the size of their original, uncompressed contents. When a file implementing
+// GzipByter is served using its gzip compressed bytes, and it also implements
+// OriginalSizer, that size is reported in the "X-Uncompressed-Content-Length"
+// response header, for clients that want to know it.
+type OriginalSizer interface {
+	// OriginalSize returns the size of the uncompressed contents of the file, in bytes.
+	OriginalSize() int64
+}
+
 // NotWorthGzipCompressing is implemented by files that were determined
 // not to be worth gzip compressing (the file size did not decrease as a result).
 type NotWorthGzipCompressing interface {
@@ -29,62 +46,228 @@ type NotWorthGzipCompressing interface {
 	NotWorthGzipCompressing()
 }
 
+// DisableCompression returns a copy of ctx that makes ServeContent serve
+// responses to requests with it without compression, such as for content
+// known not to be compressible, like encrypted payloads. It's useful where
+// content can't implement NotWorthGzipCompressing, such as in middleware.
+func DisableCompression(ctx context.Context) context.Context {
+	return context.WithValue(ctx, disableCompressionContextKey, true)
+}
+
+// disableCompressionContextKey is a context key set by DisableCompression.
+var disableCompressionContextKey = &contextKey{"disable-compression"}
+
+// compressionDisabled reports whether ctx was returned by DisableCompression.
+func compressionDisabled(ctx context.Context) bool {
+	return ctx.Value(disableCompressionContextKey) != nil
+}
+
 // ServeContent is like http.ServeContent, except it applies gzip compression
 // if compression hasn't already been done (i.e., the "Content-Encoding" header is set).
+// Responses with a "Transfer-Encoding" header set are served as is too.
 // It's aware of GzipByter and NotWorthGzipCompressing interfaces, and uses them
 // to improve performance when the provided content implements them. Otherwise,
 // it applies gzip compression on the fly, if it's found to be beneficial.
-func ServeContent(fs *fileServer, w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.ReadSeeker) {
-	// If compression has already been dealt with, serve as is.
-	if _, ok := w.Header()["Content-Encoding"]; ok {
-		http.ServeContent(w, req, name, modTime, content)
-		return
+//
+// ServeContent negotiates among all registered encodings (see RegisterEncoding)
+// that the request accepts. Precompressed variants of the file are preferred
+// over compressing on the fly. They're looked up next to fpath in the root
+// file system of fs, so they're found in in-memory file systems the same
+// way as on disk. Compressed representations are seekable,
+// so range requests are supported for all of them, addressing the encoded bytes,
+// unless disabled via FileServerOptions.DisableDynamicRanges.
+//
+// The content type is detected from the extension of name, as with
+// http.ServeContent, or of fpath if only it has one that's known,
+// and otherwise by sniffing content.
+//
+// Precompressed variants, including those persisted to
+// FileServerOptions.PrecompressCacheDir, are looked up by fpath and modTime,
+// so content is assumed to be that of the file at fpath with modification
+// time modTime. Content is compressed on the fly for each call, whereas
+// concurrent requests for the same file served by ServeFile or the file
+// server's ServeHTTP method share a single compression.
+//
+// Like http.ServeContent, ServeContent doesn't close content; the caller retains
+// ownership of it. Precompressed variants of the file that ServeContent opens
+// itself are closed before it returns.
+func (fs *Server) ServeContent(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.ReadSeeker) {
+	fs.serveContent(w, req, name, modTime, fpath, content, false)
+}
+
+// serveContent is like ServeContent. fromRoot reports whether content was
+// opened from the root file system of fs, in which case it's known to be the
+// same for all requests with the same fpath and modTime.
+func (fs *Server) serveContent(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.ReadSeeker, fromRoot bool) {
+	err := fs.tryServeContent(w, req, name, modTime, fpath, content, fromRoot)
+	if err != nil {
+		fs.opt.ErrorHandler(w, req, err)
 	}
+}
+
+// ServeContent serves content with DefaultFileServer.
+// See (*Server).ServeContent.
+func ServeContent(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.ReadSeeker) {
+	DefaultFileServer.ServeContent(w, req, name, modTime, fpath, content)
+}
 
-	headers := httpguts.HeaderValuesContainsToken(req.Header["Accept-Encoding"], "br")
-	log.Println("Has BR header:", headers)
+// ServeContentError serves content with DefaultFileServer.
+// See (*Server).ServeContentError.
+func ServeContentError(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.ReadSeeker) error {
+	return DefaultFileServer.ServeContentError(w, req, name, modTime, fpath, content)
+}
 
-	// If request accepts Brotli, look for a precompressed variant of this file.
-	// We do not attempt to dynamically compress Brotli as it is not performant.
-	if httpguts.HeaderValuesContainsToken(req.Header["Accept-Encoding"], "br") {
-		brotliFile := fs.maybeFindBrotliFile(fpath)
-		if brotliFile != nil {
-			defer brotliFile.Close()
+// ServeContentError is like ServeContent, except it returns an error
+// if content couldn't be served, rather than serving an error response.
+// If it returns a non-nil error, no response has been written to w
+// (though some response headers may have been set), and the caller
+// is responsible for responding to the request.
+// The returned error is of type *ContentError.
+func (fs *Server) ServeContentError(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.ReadSeeker) error {
+	return fs.tryServeContent(w, req, name, modTime, fpath, content, false)
+}
 
-			wHeader := w.Header()
-			wHeader.Set("Content-Encoding", "br")
-			wHeader.Add("Vary", req.Header.Get("Accept-Encoding"))
+// tryServeContent is like ServeContentError. fromRoot is as for serveContent.
+func (fs *Server) tryServeContent(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.ReadSeeker, fromRoot bool) error {
+	if fs.disabled.Load() {
+		http.ServeContent(w, req, name, modTime, content)
+		return nil
+	}
 
-			http.ServeContent(w, req, name, modTime, brotliFile)
-			return
+	name = typeName(name, fpath)
+
+	// If compression has already been dealt with, or the response
+	// has a transfer-coding applied already, serve as is.
+	_, haveEncoding := w.Header()["Content-Encoding"]
+	_, haveTransferEncoding := w.Header()["Transfer-Encoding"]
+	if haveEncoding || haveTransferEncoding {
+		// Content-Encoding may list multiple codings, possibly in multiple
+		// header values, such as "gzip, gzip" for doubly encoded content.
+		// They're left as is, and reported as one list. Codings that aren't
+		// recognized are logged, since they likely indicate a mistake.
+		codings := contentCodings(w.Header())
+		for _, coding := range codings {
+			if !knownCoding(coding) {
+				log.Printf("httpgzip: serving %q with unrecognized Content-Encoding %q as is", name, coding)
+			}
+		}
+		encoding := strings.Join(codings, ", ")
+		if encoding == "" {
+			encoding = "identity"
 		}
+		fs.stats.served(encoding)
+		fs.serveHook(w, req, encoding)
+		http.ServeContent(w, req, name, modTime, content)
+		return nil
+	}
+
+	// Compression was disabled for this request, serve it as is.
+	if compressionDisabled(req.Context()) {
+		fs.serve(w, req, name, modTime, "identity", content)
+		return nil
 	}
 
-	// If request accepts Gzip, look for a precompressed variant of this file.
-	if httpguts.HeaderValuesContainsToken(req.Header["Accept-Encoding"], "gzip") {
-		gzipFile := fs.maybeFindGzipFile(fpath)
-		if gzipFile != nil {
-			defer gzipFile.Close()
+	// Empty content can't be made any smaller, serve it as is.
+	size, err := contentSize(content)
+	if err != nil {
+		return &ContentError{Op: "seek", Err: err}
+	}
+	if size == 0 {
+		fs.serve(w, req, name, modTime, "identity", content)
+		return nil
+	}
 
-			wHeader := w.Header()
-			wHeader.Set("Content-Encoding", "gzip")
-			wHeader.Add("Vary", req.Header.Get("Accept-Encoding"))
+	encs := fs.requestEncodings(req)
 
-			http.ServeContent(w, req, name, modTime, gzipFile)
-			return
+	// Look for a precompressed variant of this file, in order of preference.
+	// Precompressed variants are served with the modTime of the original file,
+	// so that validators describe the same resource regardless of encoding.
+	// They're only looked for within the root of fs.
+	precompressed := encs
+	fpath, inRoot := cleanPath(fpath)
+	if !inRoot {
+		log.Printf("httpgzip: not looking for precompressed variants of %q outside of root", fpath)
+		precompressed = nil
+	}
+	for _, enc := range precompressed {
+		file := fs.maybeFindVariant(enc, fpath, modTime)
+		if file == nil {
+			continue
 		}
-	} else {
-		// Request doesn't accept gzip encoding.
+		seekable, err := seekableFile(file, fs.opt.MaxReaderBufferSize)
+		if err != nil {
+			log.Printf("httpgzip: skipping precompressed %s variant of %s: %v", enc.Name(), fpath, err)
+			file.Close()
+			continue
+		}
+		file = seekable
+		if fs.opt.BufferPrecompressedSize > 0 {
+			buffered, err := bufferFile(file, fs.opt.BufferPrecompressedSize)
+			if err != nil {
+				log.Printf("httpgzip: skipping precompressed %s variant of %s: %v", enc.Name(), fpath, err)
+				file.Close()
+				continue
+			}
+			file = buffered
+		}
+		if fs.opt.VerifyPrecompressed || fs.opt.VerifyPrecompressedIntegrity {
+			err := verifyPrecompressed(enc, file)
+			if err == nil && fs.opt.VerifyPrecompressedIntegrity {
+				err = fs.verifyPrecompressedIntegrity(enc, fpath, file, size)
+			}
+			if err != nil {
+				log.Printf("httpgzip: skipping precompressed %s variant of %s: %v", enc.Name(), fpath, err)
+				file.Close()
+				continue
+			}
+		}
+		defer file.Close()
+
+		// Determine the Content-Type from the original file, since
+		// http.ServeContent would detect that of the precompressed variant.
+		if _, haveType := w.Header()["Content-Type"]; !haveType {
+			ctype, _, err := fs.contentType(name, func() (string, error) { return fs.sniff(content) })
+			if err != nil {
+				return err
+			}
+			w.Header().Set("Content-Type", ctype)
+		}
+
+		fs.stats.precompressedHits.Add(1)
+		if n, err := contentSize(file); err == nil {
+			fs.stats.bytesSaved.Add(size - n)
+		}
+		fs.serve(w, req, name, modTime, enc.Name()+"-precompressed", file)
+		return nil
+	}
+	if len(encs) > 0 {
+		fs.stats.precompressedMisses.Add(1)
+	}
+
+	// If content is already gzip compressed, serve it without compressing it again.
+	if fs.opt.DetectGzipContent {
+		gzipped, err := hasGzipMagic(content)
+		if err != nil {
+			return &ContentError{Op: "seek", Err: err}
+		}
+		if gzipped {
+			return fs.serveGzipContent(w, req, name, modTime, content, encs)
+		}
+	}
+
+	// Find the most preferred encoding that supports compression on the fly.
+	// It's chosen again once the content type is known.
+	if fs.dynamicEncoding(encs, "") == nil {
+		// Request doesn't accept any encoding we can compress with.
 		// No point continuing to try to compress this file, serve without compression.
-		http.ServeContent(w, req, name, modTime, content)
-		return
+		fs.serve(w, req, name, modTime, "identity", content)
+		return nil
 	}
 
 	// If the file is not worth gzip compressing, serve it as is.
 	if _, ok := content.(NotWorthGzipCompressing); ok {
-		w.Header()["Content-Encoding"] = nil
-		http.ServeContent(w, req, name, modTime, content)
-		return
+		fs.serve(w, req, name, modTime, "identity", content)
+		return nil
 	}
 
 	// The following cases involve compression, so we want to detect the Content-Type eagerly,
@@ -93,57 +276,896 @@ func ServeContent(fs *fileServer, w http.ResponseWriter, req *http.Request, name
 	// We do this even for the last case that serves uncompressed data so that it doesn't
 	// have to do duplicate work.
 	_, haveType := w.Header()["Content-Type"]
+	unknownType := false
 	if !haveType {
-		ctype := mime.TypeByExtension(filepath.Ext(name))
-		if ctype == "" {
-			// Read a chunk to decide between utf-8 text and binary.
-			var buf [512]byte
-			n, _ := io.ReadFull(content, buf[:])
-			ctype = http.DetectContentType(buf[:n])
-			_, err := content.Seek(0, io.SeekStart) // Rewind to output whole file.
+		var ctype string
+		ctype, unknownType, err = fs.contentType(name, func() (string, error) { return fs.sniff(content) })
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", ctype)
+	}
+	dynamic := fs.dynamicEncoding(encs, w.Header().Get("Content-Type"))
+
+	// If there are gzip encoded bytes available, use them directly.
+	if gzipFile, ok := content.(GzipByter); ok && dynamic != nil && dynamic.Name() == "gzip" {
+		fs.stats.bytesSaved.Add(size - int64(len(gzipFile.GzipBytes())))
+		if sizer, ok := content.(OriginalSizer); ok {
+			w.Header().Set("X-Uncompressed-Content-Length", strconv.FormatInt(sizer.OriginalSize(), 10))
+		}
+		fs.serve(w, req, name, modTime, "gzip-precompressed", bytes.NewReader(gzipFile.GzipBytes()))
+		return nil
+	}
+
+	// Perform compression and serve compressed bytes (if it's worth it).
+	// Whether the content type is compressible is decided by the effective
+	// Content-Type, regardless of whether it was set by the caller or detected.
+	if dynamic != nil && !unknownType && fs.compressible(w.Header().Get("Content-Type"), size) && (fs.opt.CompressGate == nil || fs.opt.CompressGate()) {
+		ctype := w.Header().Get("Content-Type")
+		compress := func(ctx context.Context) ([]byte, error) {
+			if !fs.acquireCompression() {
+				return nil, errCompressionLimit
+			}
+			defer fs.releaseCompression()
+			if fs.opt.MaxCompressTime > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, fs.opt.MaxCompressTime)
+				defer cancel()
+			}
+			compressed, err := fs.compress(ctx, content, size, dynamic, ctype, name, modTime)
+			if err == nil && inRoot {
+				// Failing to persist the output only means it's compressed again next time.
+				_ = fs.writeCachedFile(dynamic, fpath, modTime, compressed)
+			}
+			return compressed, err
+		}
+		var compressed []byte
+		if fromRoot {
+			// Concurrent requests for the same file share a single compression.
+			// It's not tied to the request that happens to do it, so that
+			// canceling that request doesn't fail the others waiting for it.
+			key := compressKey{fpath: fpath, name: name, modTime: modTime, encoding: dynamic.Name(), ctype: ctype}
+			compressed, err = fs.inflight.do(key, func() ([]byte, error) {
+				return compress(context.Background())
+			})
+		} else {
+			compressed, err = compress(req.Context())
+		}
+		if err == nil {
+			fs.stats.bytesSaved.Add(size - int64(len(compressed)))
+			if fs.opt.DisableDynamicRanges {
+				w, req = noRangesWriter{w}, withoutRanges(req)
+			}
+			fs.serve(w, req, name, modTime, dynamic.Name()+"-dynamic", bytes.NewReader(compressed))
+			return nil
+		}
+	}
+
+	// Serve as is.
+	_, err = content.Seek(0, io.SeekStart) // Rewind, since compression may have consumed some of content.
+	if err != nil {
+		return &ContentError{Op: "seek", Err: err}
+	}
+	fs.serve(w, req, name, modTime, "identity", content)
+	return nil
+}
+
+// Negotiate reports how a response to req for the file at fpath in the
+// root file system of fs, named name, would be encoded by ServeFile,
+// without serving it. encoding is the name of the content-coding, or
+// "identity" if it wouldn't be encoded, and precompressed reports whether
+// a precompressed variant would be served. It's meant for checking that
+// files have the expected precompressed variants, such as in tests.
+//
+// Only the start of the file is read, if needed to detect its content type,
+// and nothing is compressed. So Negotiate reports that a file would be
+// compressed on the fly even if it turns out not to be worth it
+// (see FileServerOptions.MinSavings), and precompressed variants aren't
+// verified beyond what FileServerOptions.VerifyPrecompressed checks.
+// FileServerOptions.CompressGate and MaxConcurrentCompressions don't apply.
+func (fs *Server) Negotiate(req *http.Request, name, fpath string) (encoding string, precompressed bool, err error) {
+	if fs.disabled.Load() || compressionDisabled(req.Context()) {
+		return "identity", false, nil
+	}
+	name = typeName(name, fpath)
+	fpath, inRoot := cleanPath(fpath)
+	if !inRoot {
+		return "", false, fmt.Errorf("httpgzip: %q is outside of root", fpath)
+	}
+	f, err := fs.root.Open(fpath)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", false, err
+	}
+	if fi.IsDir() {
+		return "", false, fmt.Errorf("httpgzip: %q is a directory", fpath)
+	}
+	if fi.Size() == 0 {
+		return "identity", false, nil
+	}
+
+	encs := fs.requestEncodings(req)
+	for _, enc := range encs {
+		file := fs.maybeFindVariant(enc, fpath, fi.ModTime())
+		if file == nil {
+			continue
+		}
+		err := error(nil)
+		if fs.opt.VerifyPrecompressed || fs.opt.VerifyPrecompressedIntegrity {
+			err = verifyPrecompressed(enc, file)
+		}
+		file.Close()
+		if err == nil {
+			return enc.Name(), true, nil
+		}
+	}
+
+	// Files that can't seek are served by ServeReader, which streams them
+	// as is if they're too large to buffer, and serves them from a buffer
+	// otherwise, so they're not seen to implement GzipByter or
+	// NotWorthGzipCompressing. Only their start is read, once it's needed.
+	seekable := canSeek(f)
+	if !seekable && fi.Size() > fs.opt.MaxReaderBufferSize {
+		return "identity", false, nil
+	}
+	var content io.ReadSeeker
+	start := func() (io.ReadSeeker, error) {
+		if content != nil {
+			return content, nil
+		}
+		if seekable {
+			content = f
+			return content, nil
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(f, sniffLen))
+		if err != nil {
+			return nil, err
+		}
+		content = bytes.NewReader(b)
+		return content, nil
+	}
+
+	if fs.opt.DetectGzipContent {
+		content, err := start()
+		if err != nil {
+			return "", false, err
+		}
+		gzipped, err := hasGzipMagic(content)
+		if err != nil {
+			return "", false, err
+		}
+		if gzipped {
+			for _, enc := range encs {
+				if enc.Name() == "gzip" {
+					return "gzip", true, nil
+				}
+			}
+			return "identity", false, nil
+		}
+	}
+	if fs.dynamicEncoding(encs, "") == nil {
+		return "identity", false, nil
+	}
+	if _, ok := f.(NotWorthGzipCompressing); ok && seekable {
+		return "identity", false, nil
+	}
+	ctype, unknownType, err := fs.contentType(name, func() (string, error) {
+		content, err := start()
+		if err != nil {
+			return "", err
+		}
+		return fs.sniff(content)
+	})
+	if err != nil {
+		return "", false, err
+	}
+	dynamic := fs.dynamicEncoding(encs, ctype)
+	if _, ok := f.(GzipByter); ok && seekable && dynamic != nil && dynamic.Name() == "gzip" {
+		return "gzip", true, nil
+	}
+	if dynamic == nil || unknownType || !fs.compressible(ctype, fi.Size()) ||
+		fs.opt.MaxCompressBytes > 0 && fi.Size() > fs.opt.MaxCompressBytes {
+		return "identity", false, nil
+	}
+	return dynamic.Name(), false, nil
+}
+
+// requestEncodings returns the encodings acceptable to req, in order of preference.
+func (fs *Server) requestEncodings(req *http.Request) []Encoding {
+	acceptEncoding := fs.acceptEncoding(req)
+	if acceptEncoding == nil && fs.opt.CompressOnMissingAcceptEncoding {
+		acceptEncoding = []string{"gzip"}
+	}
+	encs := negotiate(acceptEncoding, fs.availableEncodings(), fs.opt.EncodingPreference, fs.opt.PreferServerPreference)
+	if fs.opt.CompressionFilter != nil && !fs.opt.CompressionFilter(req) {
+		// Serve as if the request didn't accept any encoding.
+		encs = nil
+	}
+	return encs
+}
+
+// acceptEncoding returns the values of the Accept-Encoding header of req,
+// or of the header named by FileServerOptions.AcceptEncodingHeader.
+func (fs *Server) acceptEncoding(req *http.Request) []string {
+	return req.Header[http.CanonicalHeaderKey(fs.opt.AcceptEncodingHeader)]
+}
+
+// serveGzipContent serves content that is a gzip stream. It's served as is
+// if gzip is among encs, the encodings acceptable to the request.
+// Otherwise, it's decompressed and served without compression.
+func (fs *Server) serveGzipContent(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, content io.ReadSeeker, encs []Encoding) error {
+	acceptsGzip := false
+	for _, enc := range encs {
+		acceptsGzip = acceptsGzip || enc.Name() == "gzip"
+	}
+	if !acceptsGzip {
+		gr, err := gzip.NewReader(content)
+		if err != nil {
+			return &ContentError{Op: "decompress", Err: err}
+		}
+		// Bound what's read, since a small gzip stream
+		// can decompress to a very large size.
+		b, err := ioutil.ReadAll(io.LimitReader(gr, fs.opt.MaxReaderBufferSize+1))
+		if err != nil {
+			return &ContentError{Op: "decompress", Err: err}
+		}
+		if int64(len(b)) > fs.opt.MaxReaderBufferSize {
+			return &ContentError{Op: "decompress", Err: fmt.Errorf("decompressed content larger than %d bytes", fs.opt.MaxReaderBufferSize)}
+		}
+		fs.serve(w, req, name, modTime, "identity", bytes.NewReader(b))
+		return nil
+	}
+
+	// Detect the Content-Type of the decompressed content, since http.ServeContent
+	// would detect that of the gzip stream.
+	if _, haveType := w.Header()["Content-Type"]; !haveType {
+		ctype, _, err := fs.contentType(name, func() (string, error) {
+			gr, err := gzip.NewReader(content)
 			if err != nil {
-				http.Error(w, "500 Internal Server Error\n\nseeker can't seek", http.StatusInternalServerError)
-				return
+				return "", &ContentError{Op: "decompress", Err: err}
 			}
+			// Sniff the decompressed stream, then rewind content.
+			return fs.sniff(struct {
+				io.Reader
+				io.Seeker
+			}{gr, content})
+		})
+		if err != nil {
+			return err
 		}
 		w.Header().Set("Content-Type", ctype)
 	}
+	fs.serve(w, req, name, modTime, "gzip-precompressed", content)
+	return nil
+}
 
-	// If there are gzip encoded bytes available, use them directly.
-	if gzipFile, ok := content.(GzipByter); ok {
-		w.Header().Set("Content-Encoding", "gzip")
-		http.ServeContent(w, req, name, modTime, bytes.NewReader(gzipFile.GzipBytes()))
+// serve serves content using http.ServeContent. compression describes
+// how content is encoded, in the format of the X-Compression debug header,
+// such as "gzip-dynamic" or "identity". It's the single place where
+// ServeContent sets the encoding headers of a response, based on compression.
+//
+// For encoded content, serve sets the "Content-Encoding" and "Vary" headers,
+// and makes sure they're kept on "304 Not Modified" responses, which
+// http.ServeContent would otherwise strip "Content-Encoding" from.
+// Any "Content-Length" header set by the caller is removed, since it describes
+// the unencoded content, and http.ServeContent doesn't replace it for encoded content.
+func (fs *Server) serve(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, compression string, content io.ReadSeeker) {
+	encoding := "identity"
+	if i := strings.LastIndex(compression, "-"); i != -1 {
+		encoding = compression[:i]
+	}
+	if encoding == "identity" {
+		w.Header().Del("Content-Encoding")
+		if _, haveType := w.Header()["Content-Type"]; !haveType && (fs.opt.DefaultContentType != "" || fs.opt.DisableSniffing) {
+			// Detect it here rather than leave it to http.ServeContent,
+			// which doesn't know about the default, and would sniff content.
+			if ctype, _, err := fs.contentType(name, func() (string, error) { return fs.sniff(content) }); err == nil {
+				w.Header().Set("Content-Type", ctype)
+			}
+		}
+	} else {
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Del("Content-Length")
+		addVary(w.Header(), http.CanonicalHeaderKey(fs.opt.AcceptEncodingHeader))
+		if fs.opt.NoTransform {
+			addCacheControl(w.Header(), "no-transform")
+		}
+		if fs.opt.CompressedByHeader {
+			w.Header().Set("X-Compressed-By", "httpgzip/"+encoding)
+		}
+		if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" {
+			w = notModifiedWriter{ResponseWriter: w, encoding: encoding}
+		}
+	}
+	if fs.opt.ComputeETag && w.Header().Get("ETag") == "" {
+		if etag, err := computeETag(content); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
+	fs.stats.served(encoding)
+	fs.setDebugHeader(w, req, compression)
+	fs.serveHook(w, req, encoding)
+	aw := &abortWriter{ResponseWriter: w}
+	http.ServeContent(aw, req, name, modTime, content)
+	if aw.err != nil {
+		fs.stats.aborted.Add(1)
+		if fs.opt.AbortHook != nil {
+			fs.opt.AbortHook(req, encoding, aw.err)
+		}
+	}
+}
+
+// abortWriter is an http.ResponseWriter that records the first error
+// writing the response body, such as when the client disconnected.
+type abortWriter struct {
+	http.ResponseWriter
+	err error
+}
+
+func (w *abortWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom, so that the underlying ResponseWriter
+// can still send files efficiently if it implements it.
+func (w *abortWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, r)
+	}
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// computeETag returns a strong entity tag derived from a hash
+// of the contents of r, and rewinds it to the start.
+func computeETag(r io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`, nil
+}
+
+// serveHook calls FileServerOptions.ServeHook, if set, with the encoding
+// that content is about to be served with.
+func (fs *Server) serveHook(w http.ResponseWriter, req *http.Request, encoding string) {
+	if fs.opt.ServeHook == nil {
 		return
 	}
+	fs.opt.ServeHook(w, req, encoding)
+}
+
+// knownCoding reports whether coding is the name of a registered encoding,
+// or one of the other standard content-codings.
+func knownCoding(coding string) bool {
+	switch strings.ToLower(coding) {
+	case "identity", "gzip", "x-gzip", "deflate", "compress", "x-compress", "br", "zstd":
+		return true
+	}
+	for _, enc := range registeredEncodings() {
+		if strings.EqualFold(enc.Name(), coding) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentCodings returns the content-codings listed in the
+// "Content-Encoding" header in h, in the order they were applied.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			if coding = strings.TrimSpace(coding); coding != "" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	return codings
+}
+
+// addVary adds field to the "Vary" header in h, unless it's already listed.
+func addVary(h http.Header, field string) {
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
 
-	// Perform compression and serve gzip compressed bytes (if it's worth it).
-	if rs, err := gzipCompress(content); err == nil {
-		w.Header().Set("Content-Encoding", "gzip")
-		http.ServeContent(w, req, name, modTime, rs)
+// addCacheControl adds directive to the "Cache-Control" header in h,
+// unless it's already listed. It's appended to the existing value, if any,
+// so that directives set by the caller are kept.
+func addCacheControl(h http.Header, directive string) {
+	values := h["Cache-Control"]
+	for _, v := range values {
+		for _, d := range strings.Split(v, ",") {
+			if name, _, _ := strings.Cut(strings.TrimSpace(d), "="); strings.EqualFold(name, directive) {
+				return
+			}
+		}
+	}
+	if n := len(values); n > 0 && strings.TrimSpace(values[n-1]) != "" {
+		values[n-1] += ", " + directive
 		return
 	}
+	h.Set("Cache-Control", directive)
+}
 
-	// Serve as is.
-	w.Header()["Content-Encoding"] = nil
-	http.ServeContent(w, req, name, modTime, content)
+// notModifiedWriter is an http.ResponseWriter that sets
+// the "Content-Encoding" header of "304 Not Modified" responses to encoding.
+type notModifiedWriter struct {
+	http.ResponseWriter
+	encoding string
+}
+
+func (w notModifiedWriter) WriteHeader(code int) {
+	if code == http.StatusNotModified {
+		w.Header().Set("Content-Encoding", w.encoding)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// ContentError describes a failure to serve content.
+type ContentError struct {
+	Op  string // Operation that failed, such as "seek".
+	Err error  // Underlying error.
+}
+
+func (e *ContentError) Error() string { return "httpgzip: " + e.Op + ": " + e.Err.Error() }
+
+// Unwrap returns the underlying error.
+func (e *ContentError) Unwrap() error { return e.Err }
+
+// serveContentError serves an error response for err returned by ServeContentError.
+// It doesn't include err.Error(), so as not to leak information to users.
+func serveContentError(w http.ResponseWriter, req *http.Request, err error) {
+	if e, ok := err.(*ContentError); ok && e.Op == "seek" {
+		http.Error(w, "500 Internal Server Error\n\nseeker can't seek", http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+}
+
+// compressible reports whether content of type ctype and given size
+// is worth attempting to compress, according to FileServerOptions.
+// Types listed in AlwaysCompressTypes take precedence over MinSize.
+func (fs *Server) compressible(ctype string, size int64) bool {
+	if fs.opt.CompressibleTypesOnly != nil {
+		if !matchesType(fs.opt.CompressibleTypesOnly, ctype) {
+			return false
+		}
+	} else if matchesType(fs.opt.IncompressibleTypes, ctype) {
+		return false
+	}
+	return size >= fs.opt.MinSize || matchesType(fs.opt.AlwaysCompressTypes, ctype)
+}
+
+// matchesType reports whether content type ctype matches any of patterns.
+// A pattern is either a media type, such as "image/png", or a type
+// with a "*" subtype wildcard, such as "video/*". Parameters of ctype,
+// such as charset, are ignored.
+func matchesType(patterns []string, ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	for _, p := range patterns {
+		if p == mediaType || strings.HasSuffix(p, "/*") && strings.HasPrefix(mediaType, p[:len(p)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// noRangesWriter is an http.ResponseWriter that advertises
+// no support for range requests in its response.
+type noRangesWriter struct {
+	http.ResponseWriter
+}
+
+func (w noRangesWriter) WriteHeader(code int) {
+	w.Header().Set("Accept-Ranges", "none")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// withoutRanges returns a copy of req without range request headers.
+func withoutRanges(req *http.Request) *http.Request {
+	r2 := req.Clone(req.Context())
+	r2.Header.Del("Range")
+	r2.Header.Del("If-Range")
+	return r2
+}
+
+// contentSize returns the size of content, and rewinds it to the start.
+func contentSize(content io.Seeker) (int64, error) {
+	size, err := content.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = content.Seek(0, io.SeekStart)
+	return size, err
+}
+
+// typeName returns name, or the base name of fpath if only the latter has
+// an extension with a known content type. Callers don't always give
+// the extension in both, so the content type is detected from either.
+func typeName(name, fpath string) string {
+	if mime.TypeByExtension(filepath.Ext(name)) != "" || mime.TypeByExtension(path.Ext(fpath)) == "" {
+		return name
+	}
+	return path.Base(fpath)
+}
+
+// contentType returns the content type of content named name. It's determined
+// from the extension of name, or if that's unknown, by calling sniff, unless
+// sniffing is disabled. If neither yields a type other than
+// "application/octet-stream", FileServerOptions.DefaultContentType is used if set.
+// unknown reports whether the type couldn't be determined at all.
+func (fs *Server) contentType(name string, sniff func() (string, error)) (ctype string, unknown bool, err error) {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype, false, nil
+	}
+	if !fs.opt.DisableSniffing {
+		ctype, err := sniff()
+		if err != nil {
+			return "", false, err
+		}
+		if ctype != "application/octet-stream" || fs.opt.DefaultContentType == "" {
+			return ctype, false, nil
+		}
+	}
+	if fs.opt.DefaultContentType != "" {
+		return fs.opt.DefaultContentType, false, nil
+	}
+	return "application/octet-stream", true, nil
+}
+
+// sniffLen is the maximum number of bytes that http.DetectContentType considers.
+const sniffLen = 512
+
+// sniffBufPool is a pool of buffers used to detect content types.
+var sniffBufPool = sync.Pool{
+	New: func() interface{} { return new([sniffLen]byte) },
+}
+
+// sniff detects the content type of content by reading up to
+// FileServerOptions.SniffSize bytes of it, and rewinds it to the start.
+func (fs *Server) sniff(content io.ReadSeeker) (string, error) {
+	n := fs.opt.SniffSize
+	if n <= 0 || n > sniffLen {
+		n = sniffLen
+	}
+	buf := sniffBufPool.Get().(*[sniffLen]byte)
+	defer sniffBufPool.Put(buf)
+
+	// Read a chunk to decide between utf-8 text and binary.
+	n, _ = io.ReadFull(content, buf[:n])
+	ctype := http.DetectContentType(buf[:n])
+	_, err := content.Seek(0, io.SeekStart) // Rewind to output whole file.
+	if err != nil {
+		return "", &ContentError{Op: "seek", Err: err}
+	}
+	return ctype, nil
+}
+
+// setDebugHeader sets the X-Compression response header to compression,
+// which describes how ServeContent encoded the response, and
+// the X-Compression-Debug response header to a description of
+// the negotiation that led to it, if enabled via FileServerOptions.DebugHeader.
+func (fs *Server) setDebugHeader(w http.ResponseWriter, req *http.Request, compression string) {
+	if !fs.opt.DebugHeader {
+		return
+	}
+	w.Header().Set("X-Compression", compression)
+
+	chosen, source := "identity", "none"
+	if i := strings.LastIndex(compression, "-"); i != -1 {
+		chosen, source = compression[:i], compression[i+1:]
+	}
+	var accepted, offered []string
+	for _, enc := range parseAcceptEncoding(fs.acceptEncoding(req)) {
+		if enc.q > 0 {
+			accepted = append(accepted, enc.coding)
+		}
+	}
+	for _, enc := range preferEncodings(fs.availableEncodings(), fs.opt.EncodingPreference) {
+		offered = append(offered, enc.Name())
+	}
+	w.Header().Set("X-Compression-Debug", fmt.Sprintf("chosen=%s, source=%s, accepted=[%s], offered=[%s]",
+		chosen, source, strings.Join(accepted, ","), strings.Join(offered, ",")))
+}
+
+// errCompressionLimit is returned when a response isn't compressed
+// because FileServerOptions.MaxConcurrentCompressions is reached.
+var errCompressionLimit = errors.New("too many concurrent compressions")
+
+// acquireCompression reports whether a response may be compressed on the fly,
+// according to FileServerOptions.MaxConcurrentCompressions. If it returns true,
+// releaseCompression must be called once compression is done.
+func (fs *Server) acquireCompression() bool {
+	if fs.compressions == nil {
+		return true
+	}
+	select {
+	case fs.compressions <- struct{}{}:
+		return true
+	default:
+		return false
+	}
 }
 
-// gzipCompress compresses input from r and returns it as an io.ReadSeeker.
-// It returns an error if compressed size is not smaller than uncompressed.
-func gzipCompress(r io.Reader) (io.ReadSeeker, error) {
+// releaseCompression releases a compression acquired by acquireCompression.
+func (fs *Server) releaseCompression() {
+	if fs.compressions == nil {
+		return
+	}
+	<-fs.compressions
+}
+
+// compress compresses input from r using enc and returns the compressed bytes.
+// It returns an error if compressed size is not smaller than uncompressed,
+// or if it saves less than FileServerOptions.MinSavings fraction of the uncompressed size.
+// If FileServerOptions.MaxCompressBytes is positive, it returns errTooLarge
+// without finishing compression if input is larger than that.
+// Compression is abandoned with ctx's error once ctx is done.
+// size is the size of input from r, used to preallocate the output buffer.
+// ctype, name and modTime describe the file being compressed.
+func (fs *Server) compress(ctx context.Context, r io.Reader, size int64, enc Encoding, ctype, name string, modTime time.Time) ([]byte, error) {
+	if fs.opt.MaxCompressBytes > 0 && size > fs.opt.MaxCompressBytes {
+		size = fs.opt.MaxCompressBytes
+	}
 	var buf bytes.Buffer
-	gw := gzip.NewWriter(&buf)
-	n, err := io.Copy(gw, r)
+	// Compressed output is only served if it's smaller than input,
+	// so expect it to be around half the size to avoid growing buf repeatedly.
+	// Large input may compress much better than that, so buf grows beyond
+	// maxCompressBufHint bytes only as output is written.
+	hint := size / 2
+	if hint > maxCompressBufHint {
+		hint = maxCompressBufHint
+	}
+	buf.Grow(int(hint))
+	n, err := fs.compressInto(ctx, &buf, r, enc, ctype, name, modTime)
 	if err != nil {
-		// No need to gw.Close() here since we're discarding the result, and gzip.Writer.Close isn't needed for cleanup.
 		return nil, err
 	}
-	err = gw.Close()
+	if !fs.worthCompressing(n, int64(buf.Len())) {
+		return nil, fmt.Errorf("not worth %s compressing: original size %v, compressed size %v", enc.Name(), n, buf.Len())
+	}
+	return buf.Bytes(), nil
+}
+
+// maxCompressBufHint is the maximum number of bytes preallocated
+// for the output of compress.
+const maxCompressBufHint = 1 << 20
+
+// CompressInto compresses content read from r with the named encoding,
+// the same way ServeContent compresses content of type ctype on the fly,
+// and appends the compressed bytes to dst. It's meant for callers that manage
+// their own buffers, such as with a sync.Pool, to avoid allocating one
+// for each compression. It reports whether compressing was worth it,
+// as determined by FileServerOptions.MinSavings. If it wasn't, or if
+// there's an error, dst is left as it was.
+//
+// CompressInto returns an error if fs can't compress with the named encoding
+// on the fly, if reading from r fails, or if r has more than
+// FileServerOptions.MaxCompressBytes bytes, if that's positive.
+func (fs *Server) CompressInto(dst *bytes.Buffer, r io.Reader, encoding, ctype string) (worth bool, err error) {
+	var enc Encoding
+	for _, e := range fs.availableEncodings() {
+		if strings.EqualFold(e.Name(), encoding) && fs.compressesOnTheFly(e, ctype) {
+			enc = e
+		}
+	}
+	if enc == nil {
+		return false, fmt.Errorf("httpgzip: can't compress with %q encoding on the fly", encoding)
+	}
+	start := dst.Len()
+	n, err := fs.compressInto(context.Background(), dst, r, enc, ctype, "", time.Time{})
+	if err != nil || !fs.worthCompressing(n, int64(dst.Len()-start)) {
+		dst.Truncate(start)
+		return false, err
+	}
+	return true, nil
+}
+
+// compressInto compresses input from r using enc, and writes the compressed
+// bytes to w. It returns the number of bytes of input read from r.
+// See compress for the meaning of the other parameters.
+func (fs *Server) compressInto(ctx context.Context, w io.Writer, r io.Reader, enc Encoding, ctype, name string, modTime time.Time) (int64, error) {
+	if fs.opt.MaxCompressBytes > 0 {
+		r = &maxBytesReader{r: r, remaining: fs.opt.MaxCompressBytes + 1}
+	}
+	r = contextReader{ctx: ctx, r: r}
+	cw := fs.newWriter(enc, ctype, w)
+	if gw, ok := cw.(pooledGzipWriter); ok && fs.opt.GzipHeader {
+		gw.Name = name
+		gw.ModTime = modTime
+	}
+	n, err := io.Copy(cw, r)
+	// Close cw even if the result is discarded, so that pooled writers
+	// are returned to their pools.
+	if err1 := cw.Close(); err == nil {
+		err = err1
+	}
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	return n, nil
+}
+
+// worthCompressing reports whether compressing n bytes of input into
+// compressed bytes of output saves enough to serve the output,
+// as determined by FileServerOptions.MinSavings.
+func (fs *Server) worthCompressing(n, compressed int64) bool {
+	return compressed < n && float64(compressed) <= float64(n)*(1-fs.opt.MinSavings)
+}
+
+// compressesOnTheFly reports whether fs can compress content with enc on the fly.
+// ctype is the type of content to compress, or "" if it's not known yet.
+func (fs *Server) compressesOnTheFly(enc Encoding, ctype string) bool {
+	if isNamed(enc, fs.opt.DisabledDynamic) {
+		return false
+	}
+	switch enc.(type) {
+	case zstdEncoding:
+		return fs.zstdEncoders != nil
+	case brotliEncoding:
+		return fs.opt.DynamicBrotli && (ctype == "" || fs.opt.DynamicBrotliTypes == nil || matchesType(fs.opt.DynamicBrotliTypes, ctype))
+	}
+	if e, ok := enc.(DynamicEncoding); ok {
+		return e.CompressesOnTheFly()
+	}
+	// Writers may hold resources until they're closed, so close the probe.
+	cw := enc.NewWriter(ioutil.Discard)
+	if cw == nil {
+		return false
+	}
+	cw.Close()
+	return true
+}
+
+// dynamicEncoding returns the first of encs that fs can compress content
+// of type ctype with on the fly, or nil if there's none. ctype is "" if
+// the type of content isn't known yet.
+func (fs *Server) dynamicEncoding(encs []Encoding, ctype string) Encoding {
+	for _, enc := range encs {
+		if fs.compressesOnTheFly(enc, ctype) {
+			return enc
+		}
+	}
+	return nil
+}
+
+// newWriter returns a writer that compresses content of type ctype
+// with enc, and writes the compressed data to w. Compression levels
+// are set according to FileServerOptions.
+func (fs *Server) newWriter(enc Encoding, ctype string, w io.Writer) io.WriteCloser {
+	if _, ok := enc.(zstdEncoding); ok && fs.zstdEncoders != nil {
+		return newZstdWriter(fs.zstdEncoders, w)
+	}
+	if _, ok := enc.(brotliEncoding); ok && fs.opt.DynamicBrotli {
+		return newBrotliWriter(w)
+	}
+	if isGzipEncoding(enc) {
+		level, ok := fs.gzipLevel(ctype)
+		if !ok {
+			level = gzip.DefaultCompression
+		}
+		return newGzipWriter(w, level)
+	}
+	return enc.NewWriter(w)
+}
+
+// gzipWriters are pools of *gzip.Writer used to compress on the fly,
+// indexed by compression level, from gzip.HuffmanOnly to gzip.BestCompression.
+var gzipWriters [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+// newGzipWriter returns a gzip writer from the pool for level, which must be
+// a valid compression level, that writes the compressed data to w.
+func newGzipWriter(w io.Writer, level int) pooledGzipWriter {
+	pool := &gzipWriters[level-gzip.HuffmanOnly]
+	gw, ok := pool.Get().(*gzip.Writer)
+	if ok {
+		gw.Reset(w)
+	} else {
+		gw, _ = gzip.NewWriterLevel(w, level)
+	}
+	return pooledGzipWriter{Writer: gw, pool: pool}
+}
+
+// pooledGzipWriter is a gzip writer that's returned to its pool when closed.
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w pooledGzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.Writer.Reset(nil)
+	w.pool.Put(w.Writer)
+	return err
+}
+
+// isGzipEncoding reports whether enc is the default gzip encoding.
+func isGzipEncoding(enc Encoding) bool {
+	_, ok := enc.(gzipEncoding)
+	return ok
+}
+
+// gzipLevel returns the gzip compression level for content of type ctype,
+// according to FileServerOptions.GzipLevels. It reports false if there's
+// no valid level for ctype.
+func (fs *Server) gzipLevel(ctype string) (int, bool) {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return 0, false
+	}
+	level, ok := fs.opt.GzipLevels[mediaType]
+	if !ok {
+		level, ok = fs.opt.GzipLevels[mediaType[:strings.Index(mediaType+"/", "/")]+"/*"]
+	}
+	if !ok || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return 0, false
+	}
+	return level, true
+}
+
+// contextReader is an io.Reader that fails with ctx's error once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// errTooLarge is returned by maxBytesReader when its input exceeds the limit.
+var errTooLarge = errors.New("input too large to compress")
+
+// maxBytesReader is like io.LimitReader, except it returns errTooLarge
+// rather than io.EOF once remaining bytes have been read. Set remaining
+// to one more than the maximum allowed size to accept input of exactly that size.
+type maxBytesReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *maxBytesReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
 	}
-	if int64(buf.Len()) >= n {
-		return nil, fmt.Errorf("not worth gzip compressing: original size %v, compressed size %v", n, buf.Len())
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining <= 0 {
+		return n, errTooLarge
 	}
-	return bytes.NewReader(buf.Bytes()), nil
+	return n, err
 }
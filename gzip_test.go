@@ -1,13 +1,35 @@
 package httpgzip_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/shurcooL/httpgzip"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
 )
 
 // Test that ServeContent correctly determines the content type as "text/plain",
@@ -17,7 +39,7 @@ func TestServeContentDetectContentType(t *testing.T) {
 		content := "This is some plain text that compresses easily. " +
 			strings.Repeat("NaN", 16) + " Batman!"
 
-		httpgzip.ServeContent(w, req, "", time.Time{}, strings.NewReader(content))
+		httpgzip.ServeContent(w, req, "", time.Time{}, "", strings.NewReader(content))
 	}))
 	defer ts.Close()
 
@@ -39,6 +61,58 @@ func TestServeContentDetectContentType(t *testing.T) {
 	}
 }
 
+// Test that the package-level ServeContent, which uses DefaultFileServer,
+// can be used concurrently.
+func TestServeContentDefaultFileServer(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			httpgzip.ServeContent(rr, req, "foo.txt", time.Time{}, "/testdata/foo.txt", strings.NewReader(compressibleText))
+			if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+				t.Errorf("got Content-Encoding %q, want %q", got, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Test that DefaultFileServer doesn't look for precompressed variants
+// in the current directory.
+func TestServeContentDefaultFileServerNoPrecompressed(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.txt.gz"), []byte("precompressed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	httpgzip.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", strings.NewReader(compressibleText))
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("got Content-Encoding %q, want %q", got, want)
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(zr); err != nil || string(b) != compressibleText {
+		t.Errorf("got body %.20q, %v, want content compressed on the fly", b, err)
+	}
+}
+
 // Test that if the handler already explicitly set "Content-Encoding" header,
 // then ServeContent shouldn't try to do apply compression, just serve as is.
 func TestServeContentExplicitContentEncoding(t *testing.T) {
@@ -47,7 +121,7 @@ func TestServeContentExplicitContentEncoding(t *testing.T) {
 			strings.Repeat("NaN", 16) + " Batman!"
 
 		w.Header()["Content-Encoding"] = nil
-		httpgzip.ServeContent(w, req, "", time.Time{}, strings.NewReader(content))
+		httpgzip.ServeContent(w, req, "", time.Time{}, "", strings.NewReader(content))
 	}))
 	defer ts.Close()
 
@@ -68,3 +142,2558 @@ func TestServeContentExplicitContentEncoding(t *testing.T) {
 		t.Errorf("got:\n%q\nwant:\n%q\n", got, want)
 	}
 }
+
+// Test that the "*" wildcard in Accept-Encoding matches codings
+// that aren't listed explicitly.
+func TestServeContentAcceptEncodingWildcard(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt": compressibleText,
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{})
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "*", want: "gzip"},
+		{acceptEncoding: "*;q=0", want: ""},
+		{acceptEncoding: "gzip, *", want: "gzip"},
+		{acceptEncoding: "gzip;q=0, x-test-deflate;q=0, *", want: ""},
+	}
+	for _, tc := range tests {
+		rr := serveGet(h, "/foo.txt", tc.acceptEncoding)
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that the X-Compression header describes how the response was encoded
+// when FileServerOptions.DebugHeader is set, and is absent otherwise.
+func TestServeContentDebugHeader(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+		"bar.txt.gz": "precompressed gzip",
+	}))
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		want           string
+	}{
+		{path: "/foo.txt", acceptEncoding: "", want: "identity"},
+		{path: "/foo.txt", acceptEncoding: "gzip", want: "gzip-dynamic"},
+		{path: "/bar.txt", acceptEncoding: "gzip", want: "gzip-precompressed"},
+		{path: "/bar.txt", acceptEncoding: "br, gzip", want: "br-precompressed"},
+	}
+	for _, tc := range tests {
+		rr := serveGet(httpgzip.FileServer(fs, httpgzip.FileServerOptions{DebugHeader: true}), tc.path, tc.acceptEncoding)
+		if got := rr.Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("%s with Accept-Encoding %q: got X-Compression %q, want %q", tc.path, tc.acceptEncoding, got, tc.want)
+		}
+		rr = serveGet(httpgzip.FileServer(fs, httpgzip.FileServerOptions{}), tc.path, tc.acceptEncoding)
+		if got, ok := rr.Header()["X-Compression"]; ok {
+			t.Errorf("%s with Accept-Encoding %q: got X-Compression %q with DebugHeader unset, want none", tc.path, tc.acceptEncoding, got)
+		}
+	}
+}
+
+// Test that the X-Compression-Debug header describes the negotiation
+// when FileServerOptions.DebugHeader is set.
+func TestServeContentDebugHeaderNegotiation(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+	}))
+	h := httpgzip.NewServer(fs, httpgzip.FileServerOptions{DebugHeader: true, EncodingPreference: []string{"br", "gzip"}})
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		want           string
+	}{
+		{path: "/foo.txt", acceptEncoding: "", want: "chosen=identity, source=none, accepted=[], offered=[br,gzip,zstd,x-test-deflate]"},
+		{path: "/foo.txt", acceptEncoding: "gzip, br;q=0", want: "chosen=gzip, source=dynamic, accepted=[gzip], offered=[br,gzip,zstd,x-test-deflate]"},
+		{path: "/bar.txt", acceptEncoding: "br, gzip", want: "chosen=br, source=precompressed, accepted=[br,gzip], offered=[br,gzip,zstd,x-test-deflate]"},
+	}
+	for _, tc := range tests {
+		rr := serveGet(h, tc.path, tc.acceptEncoding)
+		if got := rr.Header().Get("X-Compression-Debug"); got != tc.want {
+			t.Errorf("%s with Accept-Encoding %q: got X-Compression-Debug %q, want %q", tc.path, tc.acceptEncoding, got, tc.want)
+		}
+	}
+
+	// Error responses don't describe the negotiation.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	h.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", brokenSeeker{strings.NewReader(compressibleText)})
+	if got, ok := rr.Header()["X-Compression-Debug"]; ok {
+		t.Errorf("error response: got X-Compression-Debug %q, want none", got)
+	}
+}
+
+// Test that on the fly compression is skipped when it saves
+// less than FileServerOptions.MinSavings of the original size.
+func TestServeContentMinSavings(t *testing.T) {
+	// Content that is one quarter repetitive and three quarters random
+	// saves a little over 20% of its size when compressed.
+	b := make([]byte, 3072)
+	rand.New(rand.NewSource(1)).Read(b)
+	content := strings.Repeat("a", 1024) + string(b)
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.bin": content,
+	}))
+	tests := []struct {
+		minSavings float64
+		want       string
+	}{
+		{minSavings: 0, want: "gzip"},
+		{minSavings: 0.1, want: "gzip"},
+		{minSavings: 0.5, want: ""},
+	}
+	for _, tc := range tests {
+		rr := serveGet(httpgzip.FileServer(fs, httpgzip.FileServerOptions{MinSavings: tc.minSavings}), "/foo.bin", "gzip")
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("MinSavings %v: got Content-Encoding %q, want %q", tc.minSavings, got, tc.want)
+		}
+		if got := rr.Body.String(); tc.want == "" && got != content {
+			t.Errorf("MinSavings %v: got body of length %d, want original content of length %d", tc.minSavings, len(got), len(content))
+		}
+	}
+}
+
+// BenchmarkServeContentMinSavings measures serving poorly compressible
+// content, which is served compressed or as is depending on MinSavings.
+func BenchmarkServeContentMinSavings(b *testing.B) {
+	r := make([]byte, 3072)
+	rand.New(rand.NewSource(1)).Read(r)
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.bin": strings.Repeat("a", 1024) + string(r),
+	}))
+	for _, minSavings := range []float64{0, 0.5} {
+		b.Run(fmt.Sprintf("MinSavings=%v", minSavings), func(b *testing.B) {
+			h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{MinSavings: minSavings})
+			req := httptest.NewRequest("GET", "/foo.bin", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+// Test that a request without an Accept-Encoding header is served
+// without compression, even if a precompressed variant is available.
+func TestServeContentNoAcceptEncoding(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+		"bar.txt.gz": "precompressed gzip",
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{})
+	for _, path := range []string{"/foo.txt", "/bar.txt"} {
+		rr := serveGet(h, path)
+		for _, key := range []string{"Content-Encoding", "Vary"} {
+			if got, ok := rr.Header()[key]; ok {
+				t.Errorf("%s: got %s header %q, want none", path, key, got)
+			}
+		}
+		if got := rr.Body.String(); got != compressibleText {
+			t.Errorf("%s: got body %q, want original content", path, got)
+		}
+	}
+}
+
+// Test that FileServerOptions.CompressOnMissingAcceptEncoding controls
+// whether requests without an Accept-Encoding header get gzip.
+func TestServeContentCompressOnMissingAcceptEncoding(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+		"bar.txt.gz": "precompressed gzip",
+	}))
+	for _, compress := range []bool{false, true} {
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{CompressOnMissingAcceptEncoding: compress, DebugHeader: true})
+		tests := []struct {
+			path           string
+			acceptEncoding []string
+			want           string
+		}{
+			{path: "/foo.txt", acceptEncoding: nil, want: "identity"},
+			{path: "/bar.txt", acceptEncoding: nil, want: "identity"},
+			{path: "/foo.txt", acceptEncoding: []string{""}, want: "identity"},
+		}
+		if compress {
+			tests[0].want, tests[1].want = "gzip-dynamic", "gzip-precompressed"
+		}
+		for _, tc := range tests {
+			if got := serveGet(h, tc.path, tc.acceptEncoding...).Header().Get("X-Compression"); got != tc.want {
+				t.Errorf("%s with Accept-Encoding %q and CompressOnMissingAcceptEncoding %v: got X-Compression %q, want %q", tc.path, tc.acceptEncoding, compress, got, tc.want)
+			}
+		}
+	}
+}
+
+// Test that a precompressed variant is served with the Last-Modified time
+// of the original file, rather than that of the precompressed file.
+func TestServeContentPrecompressedLastModified(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []struct {
+		name    string
+		modTime time.Time
+	}{
+		{name: "foo.js", modTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{name: "foo.js.gz", modTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		path := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(path, []byte(compressibleText), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, f.modTime, f.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rr := serveGet(httpgzip.FileServer(http.Dir(dir), httpgzip.FileServerOptions{}), "/foo.js", "gzip")
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Errorf("got Content-Encoding %q, want %q", got, want)
+	}
+	if got, want := rr.Header().Get("Last-Modified"), "Wed, 01 Jan 2020 00:00:00 GMT"; got != want {
+		t.Errorf("got Last-Modified %q, want %q", got, want)
+	}
+}
+
+// Test that precompressed Brotli variants are looked up in the order
+// of FileServerOptions.BrotliSuffixes.
+func TestServeContentBrotliSuffixes(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.js":         compressibleText,
+		"foo.js.br":      "quality 11",
+		"foo.js.br.fast": "fast",
+		"bar.js":         compressibleText,
+		"bar.js.br.fast": "fast",
+	}))
+	tests := []struct {
+		suffixes []string
+		path     string
+		want     string
+	}{
+		{suffixes: nil, path: "/foo.js", want: "quality 11"},
+		{suffixes: []string{".br.fast", ".br"}, path: "/foo.js", want: "fast"},
+		{suffixes: []string{".br", ".br.fast"}, path: "/bar.js", want: "fast"},
+	}
+	for _, tc := range tests {
+		rr := serveGet(httpgzip.FileServer(fs, httpgzip.FileServerOptions{BrotliSuffixes: tc.suffixes}), tc.path, "br")
+		if got := rr.Header().Get("Content-Encoding"); got != "br" {
+			t.Errorf("BrotliSuffixes %q, %s: got Content-Encoding %q, want %q", tc.suffixes, tc.path, got, "br")
+		}
+		if got := rr.Body.String(); got != tc.want {
+			t.Errorf("BrotliSuffixes %q, %s: got body %q, want %q", tc.suffixes, tc.path, got, tc.want)
+		}
+	}
+}
+
+// Test that compressing large content doesn't preallocate output
+// in proportion to its size.
+func TestServeContentLargeCompressBuffer(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{})
+	content := &hugeContent{size: 2 << 30}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fs.ServeContent(httptest.NewRecorder(), req, "foo.txt", time.Time{}, "/foo.txt", content)
+	runtime.ReadMemStats(&after)
+	if got, max := after.TotalAlloc-before.TotalAlloc, uint64(64<<20); got > max {
+		t.Errorf("allocated %d bytes, want at most %d", got, max)
+	}
+}
+
+// hugeContent is an io.ReadSeeker that claims to have size bytes,
+// but fails to read beyond the first of them.
+type hugeContent struct {
+	size int64
+	off  int64
+}
+
+func (c *hugeContent) Read(p []byte) (int, error) {
+	if c.off > 0 {
+		return 0, errors.New("read failed")
+	}
+	n := copy(p, compressibleText)
+	c.off += int64(n)
+	return n, nil
+}
+
+func (c *hugeContent) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		c.off = offset
+	case io.SeekCurrent:
+		c.off += offset
+	case io.SeekEnd:
+		c.off = c.size + offset
+	}
+	return c.off, nil
+}
+
+// Test that content larger than FileServerOptions.MaxCompressBytes
+// is served in full, without compression.
+func TestServeContentMaxCompressBytes(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt": compressibleText,
+	}))
+	tests := []struct {
+		maxCompressBytes int64
+		want             string
+	}{
+		{maxCompressBytes: 0, want: "gzip"},
+		{maxCompressBytes: int64(len(compressibleText)), want: "gzip"},
+		{maxCompressBytes: int64(len(compressibleText)) - 1, want: ""},
+		{maxCompressBytes: 100, want: ""},
+	}
+	for _, tc := range tests {
+		rr := serveGet(httpgzip.FileServer(fs, httpgzip.FileServerOptions{MaxCompressBytes: tc.maxCompressBytes}), "/foo.txt", "gzip")
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("MaxCompressBytes %d: got Content-Encoding %q, want %q", tc.maxCompressBytes, got, tc.want)
+		}
+		if got := rr.Body.String(); tc.want == "" && got != compressibleText {
+			t.Errorf("MaxCompressBytes %d: got body of length %d, want original content of length %d", tc.maxCompressBytes, len(got), len(compressibleText))
+		}
+	}
+}
+
+// Test that an empty file is served as is, without compression.
+func TestServeContentEmpty(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"empty.txt": "",
+	}))
+	rr := serveGet(httpgzip.FileServer(fs, httpgzip.FileServerOptions{DebugHeader: true}), "/empty.txt", "gzip")
+	if got, want := rr.Code, http.StatusOK; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got := rr.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("got Content-Encoding %q, want none", got)
+	}
+	if got, want := rr.Header().Get("X-Compression"), "identity"; got != want {
+		t.Errorf("got X-Compression %q, want %q", got, want)
+	}
+	if got := rr.Body.Len(); got != 0 {
+		t.Errorf("got body of length %d, want empty", got)
+	}
+}
+
+// Test that gzip output compressed on the fly carries the file name
+// and modification time only if FileServerOptions.GzipHeader is set.
+func TestServeContentGzipHeader(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	path := filepath.Join(dir, "foo.txt")
+	if err := ioutil.WriteFile(path, []byte(compressibleText), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	for _, gzipHeader := range []bool{false, true} {
+		rr := serveGet(httpgzip.FileServer(http.Dir(dir), httpgzip.FileServerOptions{GzipHeader: gzipHeader}), "/foo.txt", "gzip")
+		gr, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantName, wantModTime := "", time.Time{}
+		if gzipHeader {
+			wantName, wantModTime = "foo.txt", modTime
+		}
+		if gr.Name != wantName {
+			t.Errorf("GzipHeader %v: got Name %q, want %q", gzipHeader, gr.Name, wantName)
+		}
+		if !gr.ModTime.Equal(wantModTime) {
+			t.Errorf("GzipHeader %v: got ModTime %v, want %v", gzipHeader, gr.ModTime, wantModTime)
+		}
+	}
+}
+
+// Test that ServeContentError reports content that can't be seeked,
+// and ServeContent responds with 500 Internal Server Error.
+func TestServeContentErrorSeek(t *testing.T) {
+	fs := httpgzip.NewServer(http.Dir("."), httpgzip.FileServerOptions{})
+	req := httptest.NewRequest("GET", "/foo.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	err := fs.ServeContentError(httptest.NewRecorder(), req, "foo.txt", time.Time{}, "/foo.txt", brokenSeeker{strings.NewReader(compressibleText)})
+	if e, ok := err.(*httpgzip.ContentError); !ok || e.Op != "seek" || e.Err != errBrokenSeeker {
+		t.Errorf("got error %#v, want *httpgzip.ContentError with Op %q", err, "seek")
+	}
+
+	rr := httptest.NewRecorder()
+	fs.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", brokenSeeker{strings.NewReader(compressibleText)})
+	if got, want := rr.Code, http.StatusInternalServerError; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+	if got, want := rr.Body.String(), "500 Internal Server Error\n\nseeker can't seek\n"; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+}
+
+// Test that a custom FileServerOptions.ErrorHandler is used
+// to serve internal errors.
+func TestServeContentErrorHandler(t *testing.T) {
+	var got error
+	fs := httpgzip.NewServer(http.Dir("."), httpgzip.FileServerOptions{
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			got = err
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `{"error":"internal"}`)
+		},
+	})
+	req := httptest.NewRequest("GET", "/foo.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	fs.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", brokenSeeker{strings.NewReader(compressibleText)})
+	if e, ok := got.(*httpgzip.ContentError); !ok || e.Err != errBrokenSeeker {
+		t.Errorf("ErrorHandler got error %#v, want *httpgzip.ContentError", got)
+	}
+	if got, want := rr.Body.String(), `{"error":"internal"}`; got != want {
+		t.Errorf("got body %q, want %q", got, want)
+	}
+}
+
+// Test that content of incompressible types isn't compressed,
+// whether the type was set by the caller or detected.
+func TestServeContentIncompressibleTypes(t *testing.T) {
+	fs := httpgzip.NewServer(http.Dir("."), httpgzip.FileServerOptions{})
+	png := "\x89PNG\x0d\x0a\x1a\x0a" + compressibleText
+	tests := []struct {
+		name    string
+		ctype   string // Content-Type set by caller, if any.
+		content string
+		want    string
+	}{
+		{name: "foo.txt", content: compressibleText, want: "gzip"},
+		{name: "foo.txt", ctype: "image/png", content: compressibleText, want: ""},
+		{name: "foo.txt", ctype: "video/mp4", content: compressibleText, want: ""},
+		{name: "foo.png", content: png, want: ""},
+		{name: "foo", content: png, want: ""},
+		{name: "foo", ctype: "text/plain; charset=utf-8", content: png, want: "gzip"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/"+tc.name, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		if tc.ctype != "" {
+			rr.Header().Set("Content-Type", tc.ctype)
+		}
+		fs.ServeContent(rr, req, tc.name, time.Time{}, "/"+tc.name, strings.NewReader(tc.content))
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("%s with Content-Type %q: got Content-Encoding %q, want %q", tc.name, tc.ctype, got, tc.want)
+		}
+	}
+}
+
+// Test that FileServerOptions.CompressibleTypesOnly restricts compression
+// to the listed types, taking precedence over IncompressibleTypes.
+func TestServeContentCompressibleTypesOnly(t *testing.T) {
+	fs := httpgzip.NewServer(http.Dir("."), httpgzip.FileServerOptions{
+		CompressibleTypesOnly: []string{"text/*", "image/png"},
+		AlwaysCompressTypes:   []string{"application/json"},
+		MinSize:               100,
+	})
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "foo.txt", content: compressibleText, want: "gzip"},
+		{name: "foo.png", content: compressibleText, want: "gzip"}, // Allowed despite IncompressibleTypes.
+		{name: "foo.js", content: compressibleText, want: "gzip"},
+		{name: "foo.json", content: compressibleText, want: ""},
+		{name: "foo.json", content: `{"small":true}`, want: ""}, // Not allowed despite AlwaysCompressTypes.
+		{name: "foo.svg", content: compressibleText, want: ""},
+		{name: "foo.txt", content: "small", want: ""}, // Allowed, but smaller than MinSize.
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/"+tc.name, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		fs.ServeContent(rr, req, tc.name, time.Time{}, "", strings.NewReader(tc.content))
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("%s (%s): got Content-Encoding %q, want %q", tc.name, rr.Header().Get("Content-Type"), got, tc.want)
+		}
+	}
+}
+
+var errBrokenSeeker = errors.New("broken seeker")
+
+// brokenSeeker is an io.ReadSeeker whose Seek method always fails.
+type brokenSeeker struct{ io.Reader }
+
+func (brokenSeeker) Seek(int64, int) (int64, error) { return 0, errBrokenSeeker }
+
+// Test that Accept-Encoding header values split across
+// multiple header lines are negotiated as one list.
+func TestServeContentMultipleAcceptEncodingLines(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"foo.txt.br": "precompressed brotli",
+		"foo.txt.gz": "precompressed gzip",
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{})
+	tests := []struct {
+		acceptEncoding []string
+		want           string
+	}{
+		{acceptEncoding: []string{"identity", "gzip"}, want: "gzip"},
+		{acceptEncoding: []string{"br;q=0.5", "gzip"}, want: "gzip"},
+		{acceptEncoding: []string{"gzip;q=0.5", "br"}, want: "br"},
+		{acceptEncoding: []string{"br;q=0", "gzip;q=0.5, br;q=0.8"}, want: "br"},
+	}
+	for _, tc := range tests {
+		rr := serveGet(h, "/foo.txt", tc.acceptEncoding...)
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that precompressed variants are chosen by the quality values
+// of the request, rather than in a fixed order.
+func TestServeContentPrecompressedQValues(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"foo.txt.br": "precompressed brotli",
+		"foo.txt.gz": "precompressed gzip",
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{DebugHeader: true})
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "br;q=1.0, gzip;q=0.5", want: "br-precompressed"},
+		{acceptEncoding: "br;q=0.5, gzip;q=1.0", want: "gzip-precompressed"},
+		{acceptEncoding: "gzip;q=0.5, br;q=0.6", want: "br-precompressed"},
+		{acceptEncoding: "gzip, br", want: "br-precompressed"}, // Equal quality, in order of registration.
+	}
+	for _, tc := range tests {
+		rr := serveGet(h, "/foo.txt", tc.acceptEncoding)
+		if got := rr.Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("Accept-Encoding %q: got X-Compression %q, want %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that responses served by all code paths advertise byte range support,
+// and that ranges address the bytes of the served representation.
+func TestServeContentAcceptRanges(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+		"bar.txt.gz": "precompressed gzip",
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{DebugHeader: true})
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		wantPath       string
+	}{
+		{path: "/foo.txt", acceptEncoding: "identity", wantPath: "identity"},
+		{path: "/foo.txt", acceptEncoding: "gzip", wantPath: "gzip-dynamic"},
+		{path: "/bar.txt", acceptEncoding: "gzip", wantPath: "gzip-precompressed"},
+		{path: "/bar.txt", acceptEncoding: "br", wantPath: "br-precompressed"},
+	}
+	for _, tc := range tests {
+		full := serveGet(h, tc.path, tc.acceptEncoding)
+		if got := full.Header().Get("X-Compression"); got != tc.wantPath {
+			t.Fatalf("%s with Accept-Encoding %q: served by %q, want %q", tc.path, tc.acceptEncoding, got, tc.wantPath)
+		}
+		if got, want := full.Header().Get("Accept-Ranges"), "bytes"; got != want {
+			t.Errorf("%s: got Accept-Ranges %q, want %q", tc.wantPath, got, want)
+		}
+
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		req.Header.Set("Range", "bytes=2-5")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got, want := rr.Code, http.StatusPartialContent; got != want {
+			t.Errorf("%s: got status %d for range request, want %d", tc.wantPath, got, want)
+		}
+		if got, want := rr.Body.String(), full.Body.String()[2:6]; got != want {
+			t.Errorf("%s: got range %q, want %q", tc.wantPath, got, want)
+		}
+	}
+}
+
+// Test that requests for multiple ranges of compressed representations get
+// multipart/byteranges responses whose parts address the encoded bytes.
+func TestServeContentMultipleRanges(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.gz": "precompressed gzip",
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{DebugHeader: true})
+	for _, tc := range []struct {
+		path     string
+		wantPath string
+	}{
+		{path: "/foo.txt", wantPath: "gzip-dynamic"},
+		{path: "/bar.txt", wantPath: "gzip-precompressed"},
+	} {
+		full := serveGet(h, tc.path, "gzip").Body.String()
+
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Range", "bytes=2-5,10-14")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got := rr.Header().Get("X-Compression"); got != tc.wantPath {
+			t.Fatalf("%s: served by %q, want %q", tc.path, got, tc.wantPath)
+		}
+		if got, want := rr.Code, http.StatusPartialContent; got != want {
+			t.Fatalf("%s: got status %d, want %d", tc.wantPath, got, want)
+		}
+		if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+			t.Errorf("%s: got Content-Encoding %q, want %q", tc.wantPath, got, want)
+		}
+		mediaType, params, err := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+		if err != nil || mediaType != "multipart/byteranges" {
+			t.Fatalf("%s: got Content-Type %q, want multipart/byteranges", tc.wantPath, rr.Header().Get("Content-Type"))
+		}
+		mr := multipart.NewReader(rr.Body, params["boundary"])
+		for _, want := range []struct{ start, end int }{{2, 5}, {10, 14}} {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatalf("%s: NextPart: %v", tc.wantPath, err)
+			}
+			if got, want := part.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+				t.Errorf("%s: got part Content-Type %q, want %q", tc.wantPath, got, want)
+			}
+			if got, want := part.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", want.start, want.end, len(full)); got != want {
+				t.Errorf("%s: got part Content-Range %q, want %q", tc.wantPath, got, want)
+			}
+			body, err := ioutil.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(body), full[want.start:want.end+1]; got != want {
+				t.Errorf("%s: got part body %q, want %q", tc.wantPath, got, want)
+			}
+		}
+		if _, err := mr.NextPart(); err != io.EOF {
+			t.Errorf("%s: got error %v after last part, want io.EOF", tc.wantPath, err)
+		}
+	}
+}
+
+// Test that FileServerOptions.EncodingPreference breaks ties between
+// encodings that are accepted equally.
+func TestServeContentEncodingPreference(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"foo.txt.br": "precompressed brotli",
+		"foo.txt.gz": "precompressed gzip",
+	}))
+	tests := []struct {
+		pref           []string
+		acceptEncoding string
+		want           string
+	}{
+		{pref: nil, acceptEncoding: "gzip, br", want: "br"},
+		{pref: []string{"gzip", "br"}, acceptEncoding: "br, gzip", want: "gzip"},
+		{pref: []string{"gzip"}, acceptEncoding: "br, gzip", want: "gzip"},
+		{pref: []string{"gzip", "br"}, acceptEncoding: "br, gzip;q=0.5", want: "br"},
+		{pref: []string{"GZIP", "Br"}, acceptEncoding: "br, gzip", want: "gzip"},
+	}
+	for _, tc := range tests {
+		rr := serveGet(httpgzip.FileServer(fs, httpgzip.FileServerOptions{EncodingPreference: tc.pref}), "/foo.txt", tc.acceptEncoding)
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("EncodingPreference %q, Accept-Encoding %q: got Content-Encoding %q, want %q", tc.pref, tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that the legacy "x-gzip" content-coding is accepted as gzip,
+// and responses use the canonical "Content-Encoding: gzip".
+func TestServeContentXGzip(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt": compressibleText,
+	}))
+	rr := serveGet(httpgzip.FileServer(fs, httpgzip.FileServerOptions{}), "/foo.txt", "x-gzip")
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("got Content-Encoding %q, want %q", got, want)
+	}
+	gr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadAll(gr); err != nil || string(got) != compressibleText {
+		t.Errorf("got decompressed body of length %d and error %v, want original content of length %d", len(got), err, len(compressibleText))
+	}
+}
+
+// Test that the casing of content-codings and parameters in Accept-Encoding
+// doesn't affect negotiation, and responses use canonical coding names.
+func TestServeContentAcceptEncodingCase(t *testing.T) {
+	h := httpgzip.FileServer(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"foo.txt.br": "precompressed brotli",
+	})), httpgzip.FileServerOptions{})
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "GZIP", want: "gzip"},
+		{acceptEncoding: "Br", want: "br"},
+		{acceptEncoding: "gzip;Q=1, BR;Q=0", want: "gzip"},
+		{acceptEncoding: "GZip;q=0.5, bR;q=0.8", want: "br"},
+		{acceptEncoding: "BR;Q=0, Gzip", want: "gzip"},
+	}
+	for _, tc := range tests {
+		if got := serveGet(h, "/foo.txt", tc.acceptEncoding).Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want %q", tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that FileServerOptions.DisabledEncodings are never negotiated,
+// even if precompressed variants encoded with them exist.
+func TestServeContentDisabledEncodings(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"foo.txt.br": "precompressed brotli",
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+		"bar.txt.gz": "precompressed gzip",
+	}))
+	tests := []struct {
+		path           string
+		disabled       []string
+		acceptEncoding string
+		want           string
+	}{
+		{path: "/foo.txt", disabled: []string{"br"}, acceptEncoding: "br, gzip;q=0.5", want: "gzip-dynamic"},
+		{path: "/bar.txt", disabled: []string{"br"}, acceptEncoding: "br, gzip;q=0.5", want: "gzip-precompressed"},
+		{path: "/foo.txt", disabled: []string{"br"}, acceptEncoding: "br", want: "identity"},
+		{path: "/bar.txt", disabled: []string{"gzip"}, acceptEncoding: "gzip", want: "identity"},
+		{path: "/bar.txt", disabled: []string{"gzip"}, acceptEncoding: "gzip, br;q=0.5", want: "br-precompressed"},
+		{path: "/foo.txt", disabled: []string{"Br"}, acceptEncoding: "br, gzip;q=0.5", want: "gzip-dynamic"},
+		{path: "/bar.txt", disabled: []string{"GZIP"}, acceptEncoding: "gzip", want: "identity"},
+	}
+	for _, tc := range tests {
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{DisabledEncodings: tc.disabled, DebugHeader: true})
+		if got := serveGet(h, tc.path, tc.acceptEncoding).Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("%s with DisabledEncodings %q and Accept-Encoding %q: got X-Compression %q, want %q", tc.path, tc.disabled, tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that FileServerOptions.DisabledPrecompressed and DisabledDynamic
+// disable precompressed variants and compressing on the fly independently.
+func TestServeContentDisabledPrecompressedAndDynamic(t *testing.T) {
+	tests := []struct {
+		opt            httpgzip.FileServerOptions
+		path           string
+		acceptEncoding string
+		want           string
+	}{
+		{path: "/bar.txt", acceptEncoding: "br, gzip;q=0.5", want: "br-precompressed"},
+		{opt: httpgzip.FileServerOptions{DisabledPrecompressed: []string{"br"}}, path: "/bar.txt", acceptEncoding: "br, gzip;q=0.5", want: "gzip-precompressed"},
+		{opt: httpgzip.FileServerOptions{DisabledPrecompressed: []string{"br", "gzip"}}, path: "/bar.txt", acceptEncoding: "br, gzip;q=0.5", want: "gzip-dynamic"},
+		{opt: httpgzip.FileServerOptions{DisabledDynamic: []string{"gzip"}}, path: "/bar.txt", acceptEncoding: "gzip", want: "gzip-precompressed"},
+		{opt: httpgzip.FileServerOptions{DisabledDynamic: []string{"gzip"}}, path: "/foo.txt", acceptEncoding: "gzip", want: "identity"},
+		{opt: httpgzip.FileServerOptions{DisabledPrecompressed: []string{"gzip"}, DisabledDynamic: []string{"gzip"}}, path: "/bar.txt", acceptEncoding: "gzip", want: "identity"},
+		{opt: httpgzip.FileServerOptions{DisabledPrecompressed: []string{"BR"}}, path: "/bar.txt", acceptEncoding: "br, gzip;q=0.5", want: "gzip-precompressed"},
+		{opt: httpgzip.FileServerOptions{DisabledDynamic: []string{"Gzip"}}, path: "/foo.txt", acceptEncoding: "gzip", want: "identity"},
+	}
+	for _, tc := range tests {
+		fs := &openCountingFS{
+			FileSystem: httpfs.New(mapfs.New(map[string]string{
+				"foo.txt":    compressibleText,
+				"bar.txt":    compressibleText,
+				"bar.txt.br": "precompressed brotli",
+				"bar.txt.gz": "precompressed gzip",
+			})),
+			opens: make(map[string]int),
+		}
+		tc.opt.DebugHeader = true
+		h := httpgzip.FileServer(fs, tc.opt)
+		if got := serveGet(h, tc.path, tc.acceptEncoding).Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("%s with DisabledPrecompressed %q, DisabledDynamic %q and Accept-Encoding %q: got X-Compression %q, want %q", tc.path, tc.opt.DisabledPrecompressed, tc.opt.DisabledDynamic, tc.acceptEncoding, got, tc.want)
+		}
+		for _, name := range tc.opt.DisabledPrecompressed {
+			variant := tc.path + map[string]string{"br": ".br", "gzip": ".gz"}[strings.ToLower(name)]
+			if n := fs.opens[variant]; n != 0 {
+				t.Errorf("%s with DisabledPrecompressed %q: %s opened %d times, want 0", tc.path, tc.opt.DisabledPrecompressed, variant, n)
+			}
+		}
+	}
+}
+
+// Test that FileServerOptions.PreferServerPreference makes the server's
+// order of preference take precedence over quality values.
+func TestServeContentPreferServerPreference(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"foo.txt.br": "precompressed brotli",
+		"foo.txt.gz": "precompressed gzip",
+	}))
+	tests := []struct {
+		pref           []string
+		acceptEncoding string
+		want           string
+	}{
+		{pref: nil, acceptEncoding: "gzip, br;q=0.5", want: "br"},
+		{pref: []string{"br", "gzip"}, acceptEncoding: "gzip, br;q=0.1", want: "br"},
+		{pref: []string{"gzip", "br"}, acceptEncoding: "br, gzip;q=0.5", want: "gzip"},
+		{pref: []string{"br", "gzip"}, acceptEncoding: "gzip, br;q=0", want: "gzip"},
+		{pref: []string{"br", "gzip"}, acceptEncoding: "gzip", want: "gzip"},
+	}
+	for _, tc := range tests {
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{EncodingPreference: tc.pref, PreferServerPreference: true})
+		rr := serveGet(h, "/foo.txt", tc.acceptEncoding)
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("EncodingPreference %q, Accept-Encoding %q: got Content-Encoding %q, want %q", tc.pref, tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that FileServerOptions.DisableDynamicRanges disables range requests
+// only for responses compressed on the fly.
+func TestServeContentDisableDynamicRanges(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.gz": "precompressed gzip",
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{DisableDynamicRanges: true})
+	tests := []struct {
+		path             string
+		acceptEncoding   string
+		wantAcceptRanges string
+		wantStatus       int
+	}{
+		{path: "/foo.txt", acceptEncoding: "gzip", wantAcceptRanges: "none", wantStatus: http.StatusOK},
+		{path: "/foo.txt", acceptEncoding: "identity", wantAcceptRanges: "bytes", wantStatus: http.StatusPartialContent},
+		{path: "/bar.txt", acceptEncoding: "gzip", wantAcceptRanges: "bytes", wantStatus: http.StatusPartialContent},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		req.Header.Set("Range", "bytes=2-5")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got := rr.Header().Get("Accept-Ranges"); got != tc.wantAcceptRanges {
+			t.Errorf("%s with Accept-Encoding %q: got Accept-Ranges %q, want %q", tc.path, tc.acceptEncoding, got, tc.wantAcceptRanges)
+		}
+		if got := rr.Code; got != tc.wantStatus {
+			t.Errorf("%s with Accept-Encoding %q: got status %d, want %d", tc.path, tc.acceptEncoding, got, tc.wantStatus)
+		}
+	}
+}
+
+// Test that content smaller than FileServerOptions.MinSize isn't compressed,
+// unless its type is listed in FileServerOptions.AlwaysCompressTypes.
+func TestServeContentAlwaysCompressTypes(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":  compressibleText,
+		"foo.json": compressibleText,
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{
+		MinSize:             int64(len(compressibleText)) + 1,
+		AlwaysCompressTypes: []string{"application/json"},
+	})
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/foo.txt", want: ""},
+		{path: "/foo.json", want: "gzip"},
+	}
+	for _, tc := range tests {
+		rr := serveGet(h, tc.path, "gzip")
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("%s: got Content-Encoding %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+// Test that FileServerOptions.CompressGate is consulted before
+// compressing on the fly, but not before serving precompressed variants.
+func TestServeContentCompressGate(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.gz": "precompressed gzip",
+	}))
+	for _, allow := range []bool{false, true} {
+		calls := 0
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{
+			CompressGate: func() bool { calls++; return allow },
+		})
+		want := ""
+		if allow {
+			want = "gzip"
+		}
+		if got := serveGet(h, "/foo.txt", "gzip").Header().Get("Content-Encoding"); got != want {
+			t.Errorf("gate %v: got Content-Encoding %q, want %q", allow, got, want)
+		}
+		if got := serveGet(h, "/bar.txt", "gzip").Header().Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("gate %v: got Content-Encoding %q for precompressed variant, want %q", allow, got, "gzip")
+		}
+		if calls != 1 {
+			t.Errorf("gate %v: called %d times, want 1", allow, calls)
+		}
+	}
+}
+
+// Test that FileServerOptions.CompressionFilter disables compression,
+// including serving precompressed variants, for requests it rejects.
+func TestServeContentCompressionFilter(t *testing.T) {
+	h := httpgzip.FileServer(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.gz": "precompressed gzip",
+	})), httpgzip.FileServerOptions{
+		CompressionFilter: func(req *http.Request) bool {
+			return !strings.Contains(req.Header.Get("User-Agent"), "BrokenProxy")
+		},
+	})
+	tests := []struct {
+		path      string
+		userAgent string
+		want      string
+	}{
+		{path: "/foo.txt", userAgent: "Mozilla/5.0", want: "gzip"},
+		{path: "/bar.txt", userAgent: "Mozilla/5.0", want: "gzip"},
+		{path: "/foo.txt", userAgent: "BrokenProxy/1.0", want: ""},
+		{path: "/bar.txt", userAgent: "BrokenProxy/1.0", want: ""},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("User-Agent", tc.userAgent)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("%s with User-Agent %q: got Content-Encoding %q, want %q", tc.path, tc.userAgent, got, tc.want)
+		}
+		if got := rr.Body.String(); tc.want == "" && got != compressibleText {
+			t.Errorf("%s with User-Agent %q: got body of length %d, want original content of length %d", tc.path, tc.userAgent, len(got), len(compressibleText))
+		}
+	}
+}
+
+// Test that FileServerOptions.DefaultContentType is used for content whose
+// type can't be determined from its extension or by sniffing.
+func TestServeContentDefaultContentType(t *testing.T) {
+	binary := "\x00\x01\x02" + compressibleText
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"README":   compressibleText,
+		"data":     binary,
+		"page.css": compressibleText,
+	}))
+	tests := []struct {
+		path            string
+		acceptEncoding  string
+		disableSniffing bool
+		want            string
+		wantEncoding    string
+	}{
+		{path: "/README", acceptEncoding: "gzip", want: "text/plain; charset=utf-8", wantEncoding: "gzip"},
+		{path: "/README", acceptEncoding: "gzip", disableSniffing: true, want: "text/markdown", wantEncoding: "gzip"},
+		{path: "/data", acceptEncoding: "gzip", want: "text/markdown", wantEncoding: "gzip"},
+		{path: "/data", acceptEncoding: "", want: "text/markdown", wantEncoding: ""},
+		{path: "/page.css", acceptEncoding: "gzip", want: "text/css; charset=utf-8", wantEncoding: "gzip"},
+	}
+	for _, tc := range tests {
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{DefaultContentType: "text/markdown", DisableSniffing: tc.disableSniffing})
+		rr := serveGet(h, tc.path, tc.acceptEncoding)
+		if got := rr.Header().Get("Content-Type"); got != tc.want {
+			t.Errorf("%s with DisableSniffing %v and Accept-Encoding %q: got Content-Type %q, want %q", tc.path, tc.disableSniffing, tc.acceptEncoding, got, tc.want)
+		}
+		if got := rr.Header().Get("Content-Encoding"); got != tc.wantEncoding {
+			t.Errorf("%s with DisableSniffing %v and Accept-Encoding %q: got Content-Encoding %q, want %q", tc.path, tc.disableSniffing, tc.acceptEncoding, got, tc.wantEncoding)
+		}
+	}
+}
+
+// Test that FileServerOptions.SniffSize limits how much content
+// is read to detect its content type.
+func TestServeContentSniffSize(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"doc": "%PDF-1.4\n" + compressibleText,
+	}))
+	tests := []struct {
+		sniffSize int
+		want      string
+	}{
+		{sniffSize: 0, want: "application/pdf"},
+		{sniffSize: 3, want: "text/plain; charset=utf-8"},
+		{sniffSize: 4096, want: "application/pdf"},
+	}
+	for _, tc := range tests {
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{SniffSize: tc.sniffSize})
+		if got := serveGet(h, "/doc", "gzip").Header().Get("Content-Type"); got != tc.want {
+			t.Errorf("SniffSize %v: got Content-Type %q, want %q", tc.sniffSize, got, tc.want)
+		}
+	}
+}
+
+// BenchmarkServeContentSniffIdentity measures serving content whose type
+// has to be sniffed, and which is then served without compression.
+func BenchmarkServeContentSniffIdentity(b *testing.B) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"doc": compressibleText,
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{MinSize: 1 << 20})
+	req := httptest.NewRequest("GET", "/doc", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// Test that content isn't read to sniff its type when the extension of its
+// name or a preset Content-Type already gives it. Each byte of content
+// is then read exactly once, to serve it.
+func TestServeContentNoSniffKnownType(t *testing.T) {
+	tests := []struct {
+		name           string
+		contentType    string
+		acceptEncoding string
+	}{
+		{name: "index.html", acceptEncoding: "gzip"},
+		{name: "index.html", acceptEncoding: ""},
+		{name: "app.js", acceptEncoding: "gzip"},
+		{name: "app.js", acceptEncoding: ""},
+		{name: "style.css", acceptEncoding: "gzip"},
+		{name: "style.css", acceptEncoding: ""},
+		{name: "doc", contentType: "text/css", acceptEncoding: "gzip"},
+		{name: "doc", contentType: "text/css", acceptEncoding: ""},
+	}
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{})
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		rr := httptest.NewRecorder()
+		if tc.contentType != "" {
+			rr.Header().Set("Content-Type", tc.contentType)
+		}
+		content := &countingReader{ReadSeeker: strings.NewReader(compressibleText)}
+		fs.ServeContent(rr, req, tc.name, time.Time{}, "", content)
+		if got, want := content.n, len(compressibleText); got != want {
+			t.Errorf("%s with Content-Type %q and Accept-Encoding %q: read %d bytes, want %d", tc.name, tc.contentType, tc.acceptEncoding, got, want)
+		}
+	}
+}
+
+// countingReader is an io.ReadSeeker that counts the bytes read from it.
+type countingReader struct {
+	io.ReadSeeker
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.n += n
+	return n, err
+}
+
+// BenchmarkServeContentKnownType measures serving content
+// whose type is known from the extension of its name.
+func BenchmarkServeContentKnownType(b *testing.B) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"style.css": compressibleText,
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{MinSize: 1 << 20})
+	req := httptest.NewRequest("GET", "/style.css", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// Test that CompressInto appends compressed bytes to the given buffer,
+// and leaves it as it was if compressing isn't worth it.
+func TestFileServerCompressInto(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{})
+	buf := bytes.NewBufferString("prefix")
+	worth, err := fs.CompressInto(buf, strings.NewReader(compressibleText), "gzip", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !worth {
+		t.Fatal("got not worth compressing, want worth it")
+	}
+	if !strings.HasPrefix(buf.String(), "prefix") {
+		t.Fatalf("got buffer %q, want it to start with %q", buf.String(), "prefix")
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()[len("prefix"):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != compressibleText {
+		t.Errorf("got decompressed %q, want %q", b, compressibleText)
+	}
+
+	buf.Reset()
+	buf.WriteString("prefix")
+	worth, err = fs.CompressInto(buf, strings.NewReader("not compressible"), "gzip", "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if worth || buf.String() != "prefix" {
+		t.Errorf("incompressible input: got worth %v and buffer %q, want false and %q", worth, buf.String(), "prefix")
+	}
+
+	if _, err := fs.CompressInto(buf, strings.NewReader(compressibleText), "br", "text/plain"); err == nil {
+		t.Error("br without DynamicBrotli: got nil error, want non-nil")
+	}
+}
+
+// BenchmarkFileServerCompressInto measures compressing
+// into a buffer that's reused across compressions.
+func BenchmarkFileServerCompressInto(b *testing.B) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{})
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.SetBytes(int64(len(compressibleText)))
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if _, err := fs.CompressInto(&buf, strings.NewReader(compressibleText), "gzip", "text/plain"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFileServerCompressIntoParallel measures concurrent compressions,
+// which share pooled writers.
+func BenchmarkFileServerCompressIntoParallel(b *testing.B) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{
+		GzipLevels: map[string]int{"text/*": gzip.BestSpeed},
+	})
+	b.ReportAllocs()
+	b.SetBytes(int64(len(compressibleText)))
+	b.RunParallel(func(pb *testing.PB) {
+		var buf bytes.Buffer
+		for pb.Next() {
+			buf.Reset()
+			if _, err := fs.CompressInto(&buf, strings.NewReader(compressibleText), "gzip", "text/plain"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkServeContentLarge(b *testing.B) {
+	var buf bytes.Buffer
+	r := rand.New(rand.NewSource(1))
+	for buf.Len() < 4<<20 {
+		// Text with some variety, so it compresses to a sizable fraction of its size.
+		fmt.Fprintf(&buf, "line %d: %x\n", buf.Len(), r.Int63())
+	}
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"large.txt": buf.String(),
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{})
+	req := httptest.NewRequest("GET", "/large.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	b.ReportAllocs()
+	b.SetBytes(int64(buf.Len()))
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+// Test that precompressed variants are served with the Content-Type of
+// the original file, rather than that of the variant.
+func TestServeContentPrecompressedContentType(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("<!DOCTYPE html><p>Hello world</p>"))
+	gw.Close()
+	h := httpgzip.FileServer(httpfs.New(mapfs.New(map[string]string{
+		"index.html":    "<!DOCTYPE html><p>Hello world</p>",
+		"index.html.gz": buf.String(),
+		"README":        compressibleText,
+		"README.gz":     buf.String(),
+	})), httpgzip.FileServerOptions{})
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/index.html", want: "text/html; charset=utf-8"},
+		{path: "/README", want: "text/plain; charset=utf-8"},
+	}
+	for _, tc := range tests {
+		rr := serveGet(h, tc.path, "gzip")
+		if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+			t.Errorf("%s: got Content-Encoding %q, want %q", tc.path, got, want)
+		}
+		if got := rr.Header().Get("Content-Type"); got != tc.want {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+// Test that precompressed variants are served for files whose types
+// are listed in FileServerOptions.IncompressibleTypes.
+func TestServeContentIncompressibleTypePrecompressed(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"data.bin":    compressibleText,
+		"data.bin.gz": "precompressed gzip",
+		"data.bin.br": "precompressed brotli",
+	}))
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{
+		IncompressibleTypes: []string{"application/octet-stream"},
+	})
+	tests := []struct {
+		acceptEncoding string
+		want           string
+		wantBody       string
+	}{
+		{acceptEncoding: "gzip", want: "gzip", wantBody: "precompressed gzip"},
+		{acceptEncoding: "br", want: "br", wantBody: "precompressed brotli"},
+		{acceptEncoding: "identity", want: "", wantBody: compressibleText},
+	}
+	for _, tc := range tests {
+		rr := serveGet(h, "/data.bin", tc.acceptEncoding)
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want %q", tc.acceptEncoding, got, tc.want)
+		}
+		if got := rr.Body.String(); got != tc.wantBody {
+			t.Errorf("Accept-Encoding %q: got body %q, want %q", tc.acceptEncoding, got, tc.wantBody)
+		}
+	}
+}
+
+// Test that FileServerOptions.MaxConcurrentCompressions causes responses
+// to be served without compression while the limit is reached.
+func TestServeContentMaxConcurrentCompressions(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{MaxConcurrentCompressions: 1})
+	serve := func(content io.ReadSeeker) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", content)
+		return rr
+	}
+
+	// Start a compression that blocks until released.
+	blocked := &blockingReader{ReadSeeker: strings.NewReader(compressibleText), reading: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(blocked) }()
+	<-blocked.reading
+
+	if got := serve(strings.NewReader(compressibleText)).Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("at limit: got Content-Encoding %q, want none", got)
+	}
+	close(blocked.release)
+	if got := (<-done).Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("blocked: got Content-Encoding %q, want %q", got, "gzip")
+	}
+	if got := serve(strings.NewReader(compressibleText)).Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("after limit: got Content-Encoding %q, want %q", got, "gzip")
+	}
+}
+
+// blockingReader is an io.ReadSeeker whose first Read closes reading,
+// then blocks until release is closed.
+type blockingReader struct {
+	io.ReadSeeker
+	reading chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		close(r.reading)
+		<-r.release
+	})
+	return r.ReadSeeker.Read(p)
+}
+
+// Test that output of on the fly compression is persisted to
+// FileServerOptions.PrecompressCacheDir and served from it afterwards,
+// until the original file is modified.
+func TestServeContentPrecompressCacheDir(t *testing.T) {
+	root, cacheDir := t.TempDir(), t.TempDir()
+	path := filepath.Join(root, "foo.txt")
+	if err := ioutil.WriteFile(path, []byte(compressibleText), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := httpgzip.FileServer(http.Dir(root), httpgzip.FileServerOptions{PrecompressCacheDir: cacheDir, DebugHeader: true})
+
+	first := serveGet(h, "/foo.txt", "gzip")
+	if got, want := first.Header().Get("X-Compression"), "gzip-dynamic"; got != want {
+		t.Fatalf("first request: served by %q, want %q", got, want)
+	}
+	cached, err := ioutil.ReadFile(filepath.Join(cacheDir, "foo.txt.gz"))
+	if err != nil {
+		t.Fatalf("first request didn't persist compressed output: %v", err)
+	}
+	if got, want := string(cached), first.Body.String(); got != want {
+		t.Errorf("persisted output differs from served response")
+	}
+
+	second := serveGet(h, "/foo.txt", "gzip")
+	if got, want := second.Header().Get("X-Compression"), "gzip-precompressed"; got != want {
+		t.Errorf("second request: served by %q, want %q", got, want)
+	}
+	if got, want := second.Body.String(), first.Body.String(); got != want {
+		t.Errorf("second request: got body of length %d, want %d", len(got), len(want))
+	}
+
+	// Modifying the original file invalidates the persisted output.
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := serveGet(h, "/foo.txt", "gzip").Header().Get("X-Compression"), "gzip-dynamic"; got != want {
+		t.Errorf("after modification: served by %q, want %q", got, want)
+	}
+	if got, want := serveGet(h, "/foo.txt", "gzip").Header().Get("X-Compression"), "gzip-precompressed"; got != want {
+		t.Errorf("after modification, second request: served by %q, want %q", got, want)
+	}
+
+	// Failing to persist output doesn't affect responses.
+	notDir := filepath.Join(root, "foo.txt")
+	h = httpgzip.FileServer(http.Dir(root), httpgzip.FileServerOptions{PrecompressCacheDir: notDir, DebugHeader: true})
+	rr := serveGet(h, "/foo.txt", "gzip")
+	if got, want := rr.Header().Get("X-Compression"), "gzip-dynamic"; got != want {
+		t.Errorf("unwritable PrecompressCacheDir: served by %q, want %q", got, want)
+	}
+	if got, want := rr.Body.String(), first.Body.String(); got != want {
+		t.Errorf("unwritable PrecompressCacheDir: got body of length %d, want %d", len(got), len(want))
+	}
+}
+
+// Test that output of encodings without precompressed variants isn't
+// persisted to FileServerOptions.PrecompressCacheDir, where it would
+// have no path of its own, and be served for other files.
+func TestServeContentPrecompressCacheDirNoVariants(t *testing.T) {
+	root, cacheDir := t.TempDir(), t.TempDir()
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a.json", "b.json"} {
+		path := filepath.Join(root, name)
+		content := strings.Repeat(`{"file":"`+name+`"}`, 100)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A variant looked up at the cache directory itself would be up to date.
+	if err := os.Chtimes(cacheDir, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	dict := []byte(`{"file":""}`)
+	h := httpgzip.FileServer(http.Dir(root), httpgzip.FileServerOptions{
+		PrecompressCacheDir: cacheDir,
+		DeflateDictionary:   dict,
+		DebugHeader:         true,
+	})
+	for _, name := range []string{"a.json", "a.json", "b.json"} {
+		rr := serveGet(h, "/"+name, "deflate")
+		if got, want := rr.Header().Get("X-Compression"), "deflate-dynamic"; got != want {
+			t.Errorf("%s: served by %q, want %q", name, got, want)
+		}
+		zr, err := zlib.NewReaderDict(rr.Body, dict)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want := `{"file":"` + name + `"}`; !strings.HasPrefix(string(b), want) {
+			t.Errorf("%s: got body starting with %.20q, want %q", name, b, want)
+		}
+	}
+	if fi, err := os.Stat(cacheDir); err != nil || !fi.IsDir() {
+		t.Errorf("PrecompressCacheDir is no longer a directory: %v, %v", fi, err)
+	}
+}
+
+// Test that compression taking longer than FileServerOptions.MaxCompressTime
+// is abandoned, and the content is served in full without compression.
+func TestServeContentMaxCompressTime(t *testing.T) {
+	serve := func(maxCompressTime time.Duration) *httptest.ResponseRecorder {
+		fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{MaxCompressTime: maxCompressTime})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		content := &slowReader{ReadSeeker: strings.NewReader(compressibleText), delay: 10 * time.Millisecond}
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", content)
+		return rr
+	}
+
+	rr := serve(time.Millisecond)
+	if got := rr.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("exceeded MaxCompressTime: got Content-Encoding %q, want none", got)
+	}
+	if got := rr.Body.String(); got != compressibleText {
+		t.Errorf("exceeded MaxCompressTime: got body of length %d, want original content of length %d", len(got), len(compressibleText))
+	}
+	if got := serve(0).Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("no MaxCompressTime: got Content-Encoding %q, want %q", got, "gzip")
+	}
+}
+
+// slowReader is an io.ReadSeeker that sleeps for delay before each Read.
+type slowReader struct {
+	io.ReadSeeker
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.ReadSeeker.Read(p)
+}
+
+// Test that "304 Not Modified" responses to conditional requests carry
+// the Content-Encoding and Vary headers of the negotiated encoding.
+func TestServeContentNotModified(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"bar.txt.gz": "precompressed gzip",
+	})), httpgzip.FileServerOptions{})
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		fpath     string
+		condition string
+		value     string
+	}{
+		{fpath: "/foo.txt", condition: "If-None-Match", value: `"v1"`},
+		{fpath: "/foo.txt", condition: "If-Modified-Since", value: modTime.Format(http.TimeFormat)},
+		{fpath: "/bar.txt", condition: "If-None-Match", value: `"v1"`},
+		{fpath: "/bar.txt", condition: "If-Modified-Since", value: modTime.Format(http.TimeFormat)},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.fpath, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set(tc.condition, tc.value)
+		rr := httptest.NewRecorder()
+		rr.Header().Set("ETag", `"v1"`)
+		fs.ServeContent(rr, req, "foo.txt", modTime, tc.fpath, strings.NewReader(compressibleText))
+		if got, want := rr.Code, http.StatusNotModified; got != want {
+			t.Errorf("%s with %s: got status %v, want %v", tc.fpath, tc.condition, got, want)
+		}
+		if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+			t.Errorf("%s with %s: got Content-Encoding %q, want %q", tc.fpath, tc.condition, got, want)
+		}
+		if got, want := rr.Header().Get("Vary"), "Accept-Encoding"; got != want {
+			t.Errorf("%s with %s: got Vary %q, want %q", tc.fpath, tc.condition, got, want)
+		}
+		if got := rr.Body.Len(); got != 0 {
+			t.Errorf("%s with %s: got body of length %d, want none", tc.fpath, tc.condition, got)
+		}
+	}
+}
+
+// Test that content isn't read to detect its type
+// when FileServerOptions.DisableSniffing is set.
+func TestServeContentDisableSniffing(t *testing.T) {
+	tests := []struct {
+		disable        bool
+		acceptEncoding string
+		wantType       string
+		wantEncoding   string
+	}{
+		{disable: false, acceptEncoding: "gzip", wantType: "text/plain; charset=utf-8", wantEncoding: "gzip"},
+		{disable: false, acceptEncoding: "", wantType: "text/plain; charset=utf-8", wantEncoding: ""},
+		{disable: true, acceptEncoding: "gzip", wantType: "application/octet-stream", wantEncoding: ""},
+		{disable: true, acceptEncoding: "", wantType: "application/octet-stream", wantEncoding: ""},
+	}
+	for _, tc := range tests {
+		fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{DisableSniffing: tc.disable})
+		content := &readCountingSeeker{ReadSeeker: strings.NewReader(compressibleText)}
+		req := httptest.NewRequest("HEAD", "/doc", nil)
+		if tc.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		fs.ServeContent(rr, req, "doc", time.Time{}, "/doc", content)
+		if got := rr.Header().Get("Content-Type"); got != tc.wantType {
+			t.Errorf("DisableSniffing %v, Accept-Encoding %q: got Content-Type %q, want %q", tc.disable, tc.acceptEncoding, got, tc.wantType)
+		}
+		if got := rr.Header().Get("Content-Encoding"); got != tc.wantEncoding {
+			t.Errorf("DisableSniffing %v, Accept-Encoding %q: got Content-Encoding %q, want %q", tc.disable, tc.acceptEncoding, got, tc.wantEncoding)
+		}
+		if got := content.reads; tc.disable && got != 0 {
+			t.Errorf("DisableSniffing %v, Accept-Encoding %q: got %d reads of content, want none", tc.disable, tc.acceptEncoding, got)
+		}
+	}
+}
+
+// Test that FileServerOptions.DisableSniffing only affects files
+// whose content type can't be determined from their extension.
+func TestFileServerDisableSniffing(t *testing.T) {
+	json := `{"text": "` + compressibleText + `"}`
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"data":      json,
+		"data.json": json,
+	}))
+	tests := []struct {
+		path    string
+		disable bool
+		want    string
+	}{
+		{path: "/data", disable: false, want: "text/plain; charset=utf-8"},
+		{path: "/data", disable: true, want: "application/octet-stream"},
+		{path: "/data.json", disable: false, want: "application/json"},
+		{path: "/data.json", disable: true, want: "application/json"},
+	}
+	for _, tc := range tests {
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{DisableSniffing: tc.disable})
+		if got := serveGet(h, tc.path, "gzip").Header().Get("Content-Type"); got != tc.want {
+			t.Errorf("%s with DisableSniffing %v: got Content-Type %q, want %q", tc.path, tc.disable, got, tc.want)
+		}
+	}
+}
+
+// readCountingSeeker is an io.ReadSeeker that counts calls to Read.
+type readCountingSeeker struct {
+	io.ReadSeeker
+	reads int
+}
+
+func (r *readCountingSeeker) Read(p []byte) (int, error) {
+	r.reads++
+	return r.ReadSeeker.Read(p)
+}
+
+// Test that headers set by the caller before calling ServeContent,
+// other than Content-Encoding and Content-Type, are kept regardless
+// of how the response is encoded.
+func TestServeContentPreservesHeaders(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"bar.txt.br": "precompressed brotli",
+		"bar.txt.gz": "precompressed gzip",
+	})), httpgzip.FileServerOptions{DebugHeader: true})
+	tests := []struct {
+		fpath          string
+		acceptEncoding string
+		content        io.ReadSeeker
+		want           string // Expected X-Compression.
+	}{
+		{fpath: "/foo.txt", acceptEncoding: "", content: strings.NewReader(compressibleText), want: "identity"},
+		{fpath: "/foo.txt", acceptEncoding: "gzip", content: strings.NewReader(""), want: "identity"},
+		{fpath: "/foo.txt", acceptEncoding: "gzip", content: strings.NewReader("short"), want: "identity"},
+		{fpath: "/foo.txt", acceptEncoding: "gzip", content: strings.NewReader(compressibleText), want: "gzip-dynamic"},
+		{fpath: "/foo.txt", acceptEncoding: "gzip", content: notWorthGzipCompressing{strings.NewReader(compressibleText)}, want: "identity"},
+		{fpath: "/foo.txt", acceptEncoding: "gzip", content: gzipByter{strings.NewReader(compressibleText), []byte("gzip bytes")}, want: "gzip-precompressed"},
+		{fpath: "/bar.txt", acceptEncoding: "gzip", content: strings.NewReader(compressibleText), want: "gzip-precompressed"},
+		{fpath: "/bar.txt", acceptEncoding: "br", content: strings.NewReader(compressibleText), want: "br-precompressed"},
+	}
+	preset := map[string]string{
+		"Cache-Control":       "public, max-age=3600",
+		"Content-Disposition": `attachment; filename="foo.txt"`,
+		"X-Custom":            "custom value",
+	}
+	for i, tc := range tests {
+		req := httptest.NewRequest("GET", tc.fpath, nil)
+		if tc.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		for k, v := range preset {
+			rr.Header().Set(k, v)
+		}
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, tc.fpath, tc.content)
+		if got := rr.Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("test %d: got X-Compression %q, want %q", i, got, tc.want)
+		}
+		for k, v := range preset {
+			if got := rr.Header().Get(k); got != v {
+				t.Errorf("test %d (%s): got %s %q, want %q", i, tc.want, k, got, v)
+			}
+		}
+	}
+}
+
+// notWorthGzipCompressing is an io.ReadSeeker that implements
+// httpgzip.NotWorthGzipCompressing.
+type notWorthGzipCompressing struct {
+	io.ReadSeeker
+}
+
+func (notWorthGzipCompressing) NotWorthGzipCompressing() {}
+
+// gzipByter is an io.ReadSeeker that implements httpgzip.GzipByter.
+type gzipByter struct {
+	io.ReadSeeker
+	gzipBytes []byte
+}
+
+func (f gzipByter) GzipBytes() []byte { return f.gzipBytes }
+
+// Test that files implementing both httpgzip.GzipByter and httpgzip.OriginalSizer
+// report their original size when served using their gzip bytes.
+func TestServeContentOriginalSizer(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{})
+	tests := []struct {
+		content        io.ReadSeeker
+		acceptEncoding string
+		want           string
+	}{
+		{content: originalSizer{gzipByter{strings.NewReader(compressibleText), []byte("gzip bytes")}, 1234}, acceptEncoding: "gzip", want: "1234"},
+		{content: originalSizer{gzipByter{strings.NewReader(compressibleText), []byte("gzip bytes")}, 1234}, acceptEncoding: "identity", want: ""},
+		{content: gzipByter{strings.NewReader(compressibleText), []byte("gzip bytes")}, acceptEncoding: "gzip", want: ""},
+	}
+	for i, tc := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		rr := httptest.NewRecorder()
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, "", tc.content)
+		if got := rr.Header().Get("X-Uncompressed-Content-Length"); got != tc.want {
+			t.Errorf("test %d: got X-Uncompressed-Content-Length %q, want %q", i, got, tc.want)
+		}
+	}
+}
+
+// originalSizer is a gzipByter that implements httpgzip.OriginalSizer.
+type originalSizer struct {
+	gzipByter
+	size int64
+}
+
+func (f originalSizer) OriginalSize() int64 { return f.size }
+
+// Test that precompressed gzip variants without a gzip header are skipped
+// when FileServerOptions.VerifyPrecompressed is set.
+func TestServeContentVerifyPrecompressed(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(compressibleText))
+	gw.Close()
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"good.txt":     compressibleText,
+		"good.txt.gz":  buf.String(),
+		"bad.txt":      compressibleText,
+		"bad.txt.gz":   "corrupt gzip",
+		"empty.txt":    compressibleText,
+		"empty.txt.gz": "",
+	}))
+	tests := []struct {
+		path   string
+		verify bool
+		want   string
+	}{
+		{path: "/good.txt", verify: false, want: "gzip-precompressed"},
+		{path: "/good.txt", verify: true, want: "gzip-precompressed"},
+		{path: "/bad.txt", verify: false, want: "gzip-precompressed"},
+		{path: "/bad.txt", verify: true, want: "gzip-dynamic"},
+		{path: "/empty.txt", verify: true, want: "gzip-dynamic"},
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, tc := range tests {
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{VerifyPrecompressed: tc.verify, DebugHeader: true})
+		rr := serveGet(h, tc.path, "gzip")
+		if got := rr.Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("%s with VerifyPrecompressed %v: got X-Compression %q, want %q", tc.path, tc.verify, got, tc.want)
+		}
+	}
+}
+
+// Test that FileServerOptions.VerifyPrecompressedIntegrity skips gzip
+// variants with corrupt trailers, or that don't decompress to the original
+// file, and that variants are only verified once while unmodified.
+func TestServeContentVerifyPrecompressedIntegrity(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write([]byte(s))
+		gw.Close()
+		return buf.Bytes()
+	}
+	good := gzipped(compressibleText)
+	badCRC := append([]byte(nil), good...)
+	badCRC[len(badCRC)-8] ^= 0xff
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := fstest.MapFS{
+		"good.txt":      {Data: []byte(compressibleText)},
+		"good.txt.gz":   {Data: good, ModTime: modTime},
+		"badcrc.txt":    {Data: []byte(compressibleText)},
+		"badcrc.txt.gz": {Data: badCRC},
+		"trunc.txt":     {Data: []byte(compressibleText)},
+		"trunc.txt.gz":  {Data: good[:len(good)-4]},
+		"other.txt":     {Data: []byte(compressibleText)},
+		"other.txt.gz":  {Data: gzipped(compressibleText + "more")},
+	}
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	h := httpgzip.FileServer(http.FS(files), httpgzip.FileServerOptions{VerifyPrecompressedIntegrity: true, DebugHeader: true})
+	for _, tc := range []struct{ path, want string }{
+		{path: "/good.txt", want: "gzip-precompressed"},
+		{path: "/badcrc.txt", want: "gzip-dynamic"},
+		{path: "/trunc.txt", want: "gzip-dynamic"},
+		{path: "/other.txt", want: "gzip-dynamic"},
+	} {
+		if got := serveGet(h, tc.path, "gzip").Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("%s: got X-Compression %q, want %q", tc.path, got, tc.want)
+		}
+	}
+
+	// Corrupting the verified variant without changing its modification time
+	// isn't noticed, since it's not verified again.
+	files["good.txt.gz"].Data = badCRC
+	if got, want := serveGet(h, "/good.txt", "gzip").Header().Get("X-Compression"), "gzip-precompressed"; got != want {
+		t.Errorf("after corruption: got X-Compression %q, want %q", got, want)
+	}
+	files["good.txt.gz"].ModTime = modTime.Add(time.Second)
+	if got, want := serveGet(h, "/good.txt", "gzip").Header().Get("X-Compression"), "gzip-dynamic"; got != want {
+		t.Errorf("after modification: got X-Compression %q, want %q", got, want)
+	}
+}
+
+// Test that responses served without compression don't have
+// a Content-Encoding header, not even an empty one.
+func TestServeContentIdentityNoContentEncoding(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{})
+	for _, content := range []io.ReadSeeker{
+		strings.NewReader("short"),
+		strings.NewReader(""),
+		notWorthGzipCompressing{strings.NewReader(compressibleText)},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fs.ServeContent(w, req, "foo.txt", time.Time{}, "/foo.txt", content)
+			// The key must be absent from the header map too,
+			// not merely present with a nil value.
+			if got, ok := w.Header()["Content-Encoding"]; ok {
+				t.Errorf("%T: got Content-Encoding key with value %q in header map, want none", content, got)
+			}
+		}))
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		ts.Close()
+		if got, ok := resp.Header["Content-Encoding"]; ok {
+			t.Errorf("%T: got Content-Encoding header %q, want none", content, got)
+		}
+	}
+}
+
+// Test that no stale Content-Encoding header survives falling through
+// from unusable precompressed variants to serving without compression.
+func TestServeContentFallthroughNoStaleEncoding(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt.gz": "corrupt gzip",
+	})), httpgzip.FileServerOptions{VerifyPrecompressed: true, DebugHeader: true})
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, content := range []io.ReadSeeker{
+		strings.NewReader("short"),
+		notWorthGzipCompressing{strings.NewReader(compressibleText)},
+	} {
+		req := httptest.NewRequest("GET", "/foo.txt", nil)
+		req.Header.Set("Accept-Encoding", "br, gzip")
+		rr := httptest.NewRecorder()
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", content)
+		if got, want := rr.Header().Get("X-Compression"), "identity"; got != want {
+			t.Errorf("%T: got X-Compression %q, want %q", content, got, want)
+		}
+		for _, key := range []string{"Content-Encoding", "Vary"} {
+			if got, ok := rr.Header()[key]; ok {
+				t.Errorf("%T: got %s header %q, want none", content, key, got)
+			}
+		}
+	}
+}
+
+// Test that a Content-Length header set by the caller doesn't truncate
+// responses compressed on the fly.
+func TestServeContentStaleContentLength(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		fs.ServeContent(w, req, "foo.txt", time.Time{}, "/foo.txt", strings.NewReader(compressibleText))
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.Header.Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("got Content-Encoding %q, want %q", got, want)
+	}
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != compressibleText {
+		t.Errorf("got body of length %d, want %d", len(body), len(compressibleText))
+	}
+}
+
+// Test that content that is already a gzip stream isn't compressed again
+// when FileServerOptions.DetectGzipContent is set.
+func TestServeContentDetectGzipContent(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(compressibleText))
+	gw.Close()
+	gzipped := buf.String()
+
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{DetectGzipContent: true})
+	tests := []struct {
+		acceptEncoding string
+		wantEncoding   string
+		wantBody       string
+	}{
+		{acceptEncoding: "gzip", wantEncoding: "gzip", wantBody: gzipped},
+		{acceptEncoding: "br", wantEncoding: "", wantBody: compressibleText},
+		{acceptEncoding: "", wantEncoding: "", wantBody: compressibleText},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/doc", nil)
+		if tc.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		fs.ServeContent(rr, req, "doc", time.Time{}, "/doc", strings.NewReader(gzipped))
+		if got := rr.Header().Get("Content-Encoding"); got != tc.wantEncoding {
+			t.Errorf("Accept-Encoding %q: got Content-Encoding %q, want %q", tc.acceptEncoding, got, tc.wantEncoding)
+		}
+		if got, want := rr.Header().Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+			t.Errorf("Accept-Encoding %q: got Content-Type %q, want %q", tc.acceptEncoding, got, want)
+		}
+		if got := rr.Body.String(); got != tc.wantBody {
+			t.Errorf("Accept-Encoding %q: got body of length %d, want %d", tc.acceptEncoding, len(got), len(tc.wantBody))
+		}
+	}
+}
+
+// Test that gzip content detected with FileServerOptions.DetectGzipContent
+// is only decompressed up to FileServerOptions.MaxReaderBufferSize bytes.
+func TestServeContentDetectGzipContentBomb(t *testing.T) {
+	bomb := string(gzipBytes(t, strings.Repeat("a", 1<<20)))
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{
+		DetectGzipContent:   true,
+		MaxReaderBufferSize: 1 << 10,
+	})
+	req := httptest.NewRequest("GET", "/doc", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	rr := httptest.NewRecorder()
+	err := fs.ServeContentError(rr, req, "doc", time.Time{}, "", strings.NewReader(bomb))
+	if e, ok := err.(*httpgzip.ContentError); !ok || e.Op != "decompress" {
+		t.Errorf("got error %v, want *httpgzip.ContentError with Op %q", err, "decompress")
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("got body of %d bytes, want none written", rr.Body.Len())
+	}
+}
+
+// Test that FileServerOptions.ServeHook is called with the encoding
+// of the response, after encoding headers have been set.
+func TestServeContentServeHook(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+	}))
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		want           string
+	}{
+		{path: "/foo.txt", acceptEncoding: "", want: "identity"},
+		{path: "/foo.txt", acceptEncoding: "gzip", want: "gzip"},
+		{path: "/bar.txt", acceptEncoding: "br", want: "br"},
+	}
+	for _, tc := range tests {
+		var calls []string
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{
+			ServeHook: func(w http.ResponseWriter, req *http.Request, encoding string) {
+				calls = append(calls, encoding)
+				if got, want := w.Header().Get("Content-Encoding"), strings.TrimPrefix(encoding, "identity"); got != want {
+					t.Errorf("%s: got Content-Encoding %q in ServeHook, want %q", tc.path, got, want)
+				}
+				w.Header().Set("X-Hook", encoding)
+			},
+		})
+		rr := serveGet(h, tc.path, tc.acceptEncoding)
+		if len(calls) != 1 || calls[0] != tc.want {
+			t.Errorf("%s with Accept-Encoding %q: got ServeHook calls %q, want [%q]", tc.path, tc.acceptEncoding, calls, tc.want)
+		}
+		if got := rr.Header().Get("X-Hook"); got != tc.want {
+			t.Errorf("%s with Accept-Encoding %q: got X-Hook %q, want %q", tc.path, tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that WebAssembly modules are compressed on the fly with
+// the best gzip compression level by default, and that
+// FileServerOptions.GzipLevels sets levels by content type.
+func TestServeContentGzipLevels(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.wasm": compressibleText,
+		"foo.html": compressibleText,
+	}))
+	gzipLevel := func(level int) string {
+		var buf bytes.Buffer
+		gw, _ := gzip.NewWriterLevel(&buf, level)
+		gw.Write([]byte(compressibleText))
+		gw.Close()
+		return buf.String()
+	}
+	tests := []struct {
+		path   string
+		levels map[string]int
+		want   string
+	}{
+		{path: "/foo.wasm", levels: nil, want: gzipLevel(gzip.BestCompression)},
+		{path: "/foo.html", levels: nil, want: gzipLevel(gzip.DefaultCompression)},
+		{path: "/foo.html", levels: map[string]int{"text/*": gzip.BestSpeed}, want: gzipLevel(gzip.BestSpeed)},
+		{path: "/foo.html", levels: map[string]int{"text/*": gzip.BestSpeed, "text/html": gzip.BestCompression}, want: gzipLevel(gzip.BestCompression)},
+		{path: "/foo.wasm", levels: map[string]int{}, want: gzipLevel(gzip.DefaultCompression)},
+	}
+	for _, tc := range tests {
+		rr := serveGet(httpgzip.FileServer(fs, httpgzip.FileServerOptions{GzipLevels: tc.levels}), tc.path, "gzip")
+		if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+			t.Errorf("%s with GzipLevels %v: got Content-Encoding %q, want %q", tc.path, tc.levels, got, want)
+		}
+		if got := rr.Body.String(); got != tc.want {
+			t.Errorf("%s with GzipLevels %v: got body of length %d, want %d", tc.path, tc.levels, len(got), len(tc.want))
+		}
+	}
+}
+
+// Test that FileServerOptions.ComputeETag sets a distinct strong ETag
+// for each encoding of a file, unless one is already set.
+func TestServeContentComputeETag(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"bar.txt.br": "precompressed brotli",
+	})), httpgzip.FileServerOptions{ComputeETag: true})
+	serve := func(fpath, acceptEncoding, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", fpath, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		if etag != "" {
+			rr.Header().Set("ETag", etag)
+		}
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, fpath, strings.NewReader(compressibleText))
+		return rr
+	}
+
+	etags := make(map[string]string) // Encoding -> ETag.
+	for _, tc := range []struct{ fpath, acceptEncoding string }{
+		{fpath: "/foo.txt", acceptEncoding: "identity"},
+		{fpath: "/foo.txt", acceptEncoding: "gzip"},
+		{fpath: "/bar.txt", acceptEncoding: "br"},
+	} {
+		rr := serve(tc.fpath, tc.acceptEncoding, "")
+		etag := rr.Header().Get("ETag")
+		if !strings.HasPrefix(etag, `"`) || !strings.HasSuffix(etag, `"`) || len(etag) < 3 {
+			t.Errorf("%s: got ETag %q, want a strong entity tag", tc.acceptEncoding, etag)
+		}
+		for enc, other := range etags {
+			if etag == other {
+				t.Errorf("%s: got ETag %q, same as for %s", tc.acceptEncoding, etag, enc)
+			}
+		}
+		etags[tc.acceptEncoding] = etag
+		if got := serve(tc.fpath, tc.acceptEncoding, "").Header().Get("ETag"); got != etag {
+			t.Errorf("%s: got ETag %q when serving again, want %q", tc.acceptEncoding, got, etag)
+		}
+	}
+
+	if got, want := serve("/foo.txt", "gzip", `"custom"`).Header().Get("ETag"), `"custom"`; got != want {
+		t.Errorf("got ETag %q, want caller set %q", got, want)
+	}
+}
+
+// Test that If-Range requests are validated against the ETag of the
+// negotiated encoding's representation, so a range is only served if the
+// client's validator is for the same representation.
+func TestServeContentIfRange(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"bar.txt.gz": "precompressed gzip",
+	})), httpgzip.FileServerOptions{ComputeETag: true})
+	serve := func(fpath, acceptEncoding, ifRange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", fpath, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if ifRange != "" {
+			req.Header.Set("Range", "bytes=2-5")
+			req.Header.Set("If-Range", ifRange)
+		}
+		rr := httptest.NewRecorder()
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, fpath, strings.NewReader(compressibleText))
+		return rr
+	}
+
+	for _, fpath := range []string{"/foo.txt", "/bar.txt"} {
+		gzipped := serve(fpath, "gzip", "")
+		identity := serve(fpath, "identity", "")
+		tests := []struct {
+			acceptEncoding string
+			ifRange        string
+			wantStatus     int
+			want           *httptest.ResponseRecorder
+		}{
+			{acceptEncoding: "gzip", ifRange: gzipped.Header().Get("ETag"), wantStatus: http.StatusPartialContent, want: gzipped},
+			{acceptEncoding: "gzip", ifRange: identity.Header().Get("ETag"), wantStatus: http.StatusOK, want: gzipped},
+			{acceptEncoding: "identity", ifRange: identity.Header().Get("ETag"), wantStatus: http.StatusPartialContent, want: identity},
+			{acceptEncoding: "identity", ifRange: gzipped.Header().Get("ETag"), wantStatus: http.StatusOK, want: identity},
+		}
+		for _, tc := range tests {
+			rr := serve(fpath, tc.acceptEncoding, tc.ifRange)
+			if rr.Code != tc.wantStatus {
+				t.Errorf("%s with Accept-Encoding %q and If-Range %s: got status %d, want %d", fpath, tc.acceptEncoding, tc.ifRange, rr.Code, tc.wantStatus)
+				continue
+			}
+			want := tc.want.Body.String()
+			if tc.wantStatus == http.StatusPartialContent {
+				want = want[2:6]
+			}
+			if got := rr.Body.String(); got != want {
+				t.Errorf("%s with Accept-Encoding %q and If-Range %s: got body %q, want %q", fpath, tc.acceptEncoding, tc.ifRange, got, want)
+			}
+		}
+	}
+}
+
+// Test that content with a Content-Encoding header listing multiple
+// codings is served as is, without another coding being added.
+func TestServeContentMultipleContentEncodings(t *testing.T) {
+	for _, contentEncoding := range [][]string{
+		{"gzip, br"},
+		{"gzip", "br"},
+		{"gzip,br", ""},
+	} {
+		var hookEncoding string
+		fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+			"foo.txt.gz": "precompressed gzip",
+		})), httpgzip.FileServerOptions{
+			ServeHook: func(_ http.ResponseWriter, _ *http.Request, encoding string) { hookEncoding = encoding },
+		})
+		req := httptest.NewRequest("GET", "/foo.txt", nil)
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		rr := httptest.NewRecorder()
+		rr.Header()["Content-Encoding"] = append([]string(nil), contentEncoding...)
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", strings.NewReader("layered content"))
+		if got := rr.Header()["Content-Encoding"]; !reflect.DeepEqual(got, contentEncoding) {
+			t.Errorf("Content-Encoding %q: got Content-Encoding %q, want it unchanged", contentEncoding, got)
+		}
+		if got, want := rr.Body.String(), "layered content"; got != want {
+			t.Errorf("Content-Encoding %q: got body %q, want %q", contentEncoding, got, want)
+		}
+		if got, want := hookEncoding, "gzip, br"; got != want {
+			t.Errorf("Content-Encoding %q: got ServeHook encoding %q, want %q", contentEncoding, got, want)
+		}
+	}
+}
+
+// Test that content with a Content-Encoding listing codings, recognized or not,
+// is served as is, and that unrecognized codings are logged.
+func TestServeContentContentEncodingList(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{})
+	tests := []struct {
+		contentEncoding []string
+		wantLog         bool
+	}{
+		{contentEncoding: []string{"gzip, gzip"}, wantLog: false},
+		{contentEncoding: []string{"gzip", "gzip"}, wantLog: false},
+		{contentEncoding: []string{"GZIP, x-gzip"}, wantLog: false},
+		{contentEncoding: []string{"deflate, br"}, wantLog: false},
+		{contentEncoding: []string{"gzip, rot13"}, wantLog: true},
+		{contentEncoding: []string{"gzip", "rot13"}, wantLog: true},
+	}
+	for _, tc := range tests {
+		logs.Reset()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		rr.Header()["Content-Encoding"] = append([]string(nil), tc.contentEncoding...)
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, "", strings.NewReader(compressibleText))
+		if got := rr.Header()["Content-Encoding"]; !reflect.DeepEqual(got, tc.contentEncoding) {
+			t.Errorf("Content-Encoding %q: got Content-Encoding %q, want it unchanged", tc.contentEncoding, got)
+		}
+		if got := rr.Body.String(); got != compressibleText {
+			t.Errorf("Content-Encoding %q: got body %q, want content as is", tc.contentEncoding, got)
+		}
+		if got := strings.Contains(logs.String(), `unrecognized Content-Encoding "rot13"`); got != tc.wantLog {
+			t.Errorf("Content-Encoding %q: got logged %v, want %v (log: %q)", tc.contentEncoding, got, tc.wantLog, logs.String())
+		}
+	}
+}
+
+// Test that SetEnabled disables and re-enables compression at run time.
+func TestFileServerSetEnabled(t *testing.T) {
+	h := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.gz": "precompressed gzip",
+	})), httpgzip.FileServerOptions{})
+	check := func(state string, want string) {
+		t.Helper()
+		for _, path := range []string{"/foo.txt", "/bar.txt"} {
+			rr := serveGet(h, path, "gzip")
+			if got := rr.Header().Get("Content-Encoding"); got != want {
+				t.Errorf("%s %s: got Content-Encoding %q, want %q", state, path, got, want)
+			}
+			if got := rr.Body.String(); want == "" && got != compressibleText {
+				t.Errorf("%s %s: got body of length %d, want original content of length %d", state, path, len(got), len(compressibleText))
+			}
+		}
+	}
+	check("initially", "gzip")
+	h.SetEnabled(false)
+	check("disabled", "")
+	h.SetEnabled(true)
+	check("re-enabled", "gzip")
+}
+
+// Test that Negotiate reports the encoding that ServeFile serves with,
+// without reading content beyond what's needed to detect its type.
+func TestFileServerNegotiate(t *testing.T) {
+	files := fstest.MapFS{
+		"foo.txt":    {Data: []byte(compressibleText)},
+		"bar.txt":    {Data: []byte(compressibleText)},
+		"bar.txt.br": {Data: []byte("precompressed brotli")},
+		"small.txt":  {Data: []byte("small")},
+		"image.png":  {Data: []byte("\x89PNG\x0d\x0a\x1a\x0a" + compressibleText)},
+		"doc":        {Data: []byte(compressibleText)},
+		"empty.txt":  {},
+	}
+	h := httpgzip.NewServer(http.FS(files), httpgzip.FileServerOptions{MinSize: 100, DebugHeader: true})
+	tests := []struct {
+		fpath             string
+		acceptEncoding    string
+		wantEncoding      string
+		wantPrecompressed bool
+	}{
+		{fpath: "/foo.txt", acceptEncoding: "gzip, br", wantEncoding: "gzip"},
+		{fpath: "/foo.txt", acceptEncoding: "", wantEncoding: "identity"},
+		{fpath: "/bar.txt", acceptEncoding: "gzip, br", wantEncoding: "br", wantPrecompressed: true},
+		{fpath: "/bar.txt", acceptEncoding: "gzip", wantEncoding: "gzip"},
+		{fpath: "/small.txt", acceptEncoding: "gzip", wantEncoding: "identity"},
+		{fpath: "/image.png", acceptEncoding: "gzip", wantEncoding: "identity"},
+		{fpath: "/doc", acceptEncoding: "gzip", wantEncoding: "gzip"},
+		{fpath: "/empty.txt", acceptEncoding: "gzip", wantEncoding: "identity"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.fpath, nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		encoding, precompressed, err := h.Negotiate(req, path.Base(tc.fpath), tc.fpath)
+		if err != nil {
+			t.Errorf("%s with Accept-Encoding %q: Negotiate: %v", tc.fpath, tc.acceptEncoding, err)
+			continue
+		}
+		if encoding != tc.wantEncoding || precompressed != tc.wantPrecompressed {
+			t.Errorf("%s with Accept-Encoding %q: got %q, precompressed %v; want %q, precompressed %v", tc.fpath, tc.acceptEncoding, encoding, precompressed, tc.wantEncoding, tc.wantPrecompressed)
+		}
+
+		// Check that it matches how the file is served.
+		want := "identity"
+		if tc.wantEncoding != "identity" {
+			want = tc.wantEncoding + "-dynamic"
+			if tc.wantPrecompressed {
+				want = tc.wantEncoding + "-precompressed"
+			}
+		}
+		if got := serveGet(h, tc.fpath, tc.acceptEncoding).Header().Get("X-Compression"); got != want {
+			t.Errorf("%s with Accept-Encoding %q: served by %q, want %q", tc.fpath, tc.acceptEncoding, got, want)
+		}
+	}
+
+	if _, _, err := h.Negotiate(httptest.NewRequest("GET", "/", nil), "missing.txt", "/missing.txt"); err == nil {
+		t.Error("Negotiate for missing file: got nil error, want non-nil")
+	}
+}
+
+// Test that Negotiate agrees with ServeFile about files that implement
+// httpgzip.GzipByter or httpgzip.NotWorthGzipCompressing.
+func TestFileServerNegotiateOptionalInterfaces(t *testing.T) {
+	files := httpfs.New(mapfs.New(map[string]string{"foo.txt": compressibleText}))
+	tests := []struct {
+		name              string
+		h                 *httpgzip.Server
+		wantEncoding      string
+		wantPrecompressed bool
+		want              string // X-Compression header.
+	}{
+		{
+			name:              "GzipByter",
+			h:                 httpgzip.NewServer(gzipByterFS{files}, httpgzip.FileServerOptions{DebugHeader: true}),
+			wantEncoding:      "gzip",
+			wantPrecompressed: true,
+			want:              "gzip-precompressed",
+		},
+		{
+			name:         "NotWorthGzipCompressing",
+			h:            httpgzip.NewServer(notWorthGzipCompressingFS{files}, httpgzip.FileServerOptions{DebugHeader: true}),
+			wantEncoding: "identity",
+			want:         "identity",
+		},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/foo.txt", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		encoding, precompressed, err := tc.h.Negotiate(req, "foo.txt", "/foo.txt")
+		if err != nil {
+			t.Errorf("%s: Negotiate: %v", tc.name, err)
+			continue
+		}
+		if encoding != tc.wantEncoding || precompressed != tc.wantPrecompressed {
+			t.Errorf("%s: got %q, precompressed %v; want %q, precompressed %v", tc.name, encoding, precompressed, tc.wantEncoding, tc.wantPrecompressed)
+		}
+		if got := serveGet(tc.h, "/foo.txt", "gzip").Header().Get("X-Compression"); got != tc.want {
+			t.Errorf("%s: served by %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Test that Negotiate only reads the start of files that can't seek,
+// rather than reading them into memory.
+func TestFileServerNegotiateNonSeekable(t *testing.T) {
+	fsys := &readCountingFS{fs: fstest.MapFS{
+		"doc": {Data: []byte(strings.Repeat(compressibleText, 5<<20/len(compressibleText)))},
+	}}
+	h := httpgzip.NewServer(http.FS(fsys), httpgzip.FileServerOptions{MaxReaderBufferSize: 10 << 20})
+	req := httptest.NewRequest("GET", "/doc", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	encoding, precompressed, err := h.Negotiate(req, "doc", "/doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoding != "gzip" || precompressed {
+		t.Errorf("got %q, precompressed %v; want %q, precompressed false", encoding, precompressed, "gzip")
+	}
+	if got, max := fsys.bytesRead, int64(512); got > max {
+		t.Errorf("read %d bytes of file, want at most %d", got, max)
+	}
+}
+
+// notWorthGzipCompressingFS is an http.FileSystem whose files implement
+// httpgzip.NotWorthGzipCompressing.
+type notWorthGzipCompressingFS struct{ http.FileSystem }
+
+func (fs notWorthGzipCompressingFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return notWorthGzipCompressingFile{f}, nil
+}
+
+type notWorthGzipCompressingFile struct{ http.File }
+
+func (notWorthGzipCompressingFile) NotWorthGzipCompressing() {}
+
+// readCountingFS is an fs.FS whose files don't implement io.Seeker,
+// and count the bytes read from them.
+type readCountingFS struct {
+	fs        fs.FS
+	bytesRead int64
+}
+
+func (fsys *readCountingFS) Open(name string) (fs.File, error) {
+	f, err := fsys.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return readCountingFile{File: f, fsys: fsys}, nil
+}
+
+type readCountingFile struct {
+	fs.File
+	fsys *readCountingFS
+}
+
+func (f readCountingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.fsys.bytesRead += int64(n)
+	return n, err
+}
+
+// Test that FileServerOptions.NoTransform adds the "no-transform" directive,
+// once, to the Cache-Control header of encoded responses only.
+func TestServeContentNoTransform(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"bar.txt.br": "precompressed brotli",
+	})), httpgzip.FileServerOptions{NoTransform: true})
+	tests := []struct {
+		fpath          string
+		acceptEncoding string
+		cacheControl   []string
+		want           []string
+	}{
+		{fpath: "/foo.txt", acceptEncoding: "gzip", want: []string{"no-transform"}},
+		{fpath: "/bar.txt", acceptEncoding: "br", want: []string{"no-transform"}},
+		{fpath: "/foo.txt", acceptEncoding: "gzip", cacheControl: []string{"public, max-age=3600"}, want: []string{"public, max-age=3600, no-transform"}},
+		{fpath: "/foo.txt", acceptEncoding: "gzip", cacheControl: []string{"No-Transform, private"}, want: []string{"No-Transform, private"}},
+		{fpath: "/foo.txt", acceptEncoding: "gzip", cacheControl: []string{"public", "max-age=60"}, want: []string{"public", "max-age=60, no-transform"}},
+		{fpath: "/foo.txt", acceptEncoding: "", want: nil},
+		{fpath: "/foo.txt", acceptEncoding: "", cacheControl: []string{"public"}, want: []string{"public"}},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.fpath, nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		rr := httptest.NewRecorder()
+		if tc.cacheControl != nil {
+			rr.Header()["Cache-Control"] = append([]string(nil), tc.cacheControl...)
+		}
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, tc.fpath, strings.NewReader(compressibleText))
+		if got := rr.Header()["Cache-Control"]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s with Accept-Encoding %q and Cache-Control %q: got Cache-Control %q, want %q", tc.fpath, tc.acceptEncoding, tc.cacheControl, got, tc.want)
+		}
+	}
+}
+
+// Test that the content type is detected from the extension of fpath
+// when name doesn't have a known one.
+func TestServeContentTypeFromFpath(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"style.css":    compressibleText,
+		"style.css.gz": "precompressed gzip",
+	})), httpgzip.FileServerOptions{})
+	tests := []struct {
+		name           string
+		fpath          string
+		acceptEncoding string
+		want           string
+	}{
+		{name: "style", fpath: "/style.css", acceptEncoding: "gzip", want: "text/css; charset=utf-8"},
+		{name: "style", fpath: "/style.css", acceptEncoding: "", want: "text/css; charset=utf-8"},
+		{name: "", fpath: "/app.js", acceptEncoding: "gzip", want: "text/javascript; charset=utf-8"},
+		{name: "", fpath: "/app.js", acceptEncoding: "", want: "text/javascript; charset=utf-8"},
+		{name: "data.json", fpath: "/app.js", acceptEncoding: "gzip", want: "application/json"}, // name takes precedence.
+		{name: "", fpath: "/noext", acceptEncoding: "gzip", want: "text/plain; charset=utf-8"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		rr := httptest.NewRecorder()
+		fs.ServeContent(rr, req, tc.name, time.Time{}, tc.fpath, strings.NewReader(compressibleText))
+		if got := rr.Header().Get("Content-Type"); got != tc.want {
+			t.Errorf("name %q, fpath %q, Accept-Encoding %q: got Content-Type %q, want %q", tc.name, tc.fpath, tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that ServeContent doesn't compress responses to requests
+// whose context was returned by DisableCompression.
+func TestServeContentDisableCompression(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"foo.txt.gz": "precompressed gzip",
+	})), httpgzip.FileServerOptions{})
+	for _, fpath := range []string{"", "/foo.txt"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req = req.WithContext(httpgzip.DisableCompression(req.Context()))
+		rr := httptest.NewRecorder()
+		fs.ServeContent(rr, req, "foo.txt", time.Time{}, fpath, strings.NewReader(compressibleText))
+		if got := rr.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("fpath %q: got Content-Encoding %q, want none", fpath, got)
+		}
+		if got := rr.Body.String(); got != compressibleText {
+			t.Errorf("fpath %q: got body %q, want %q", fpath, got, compressibleText)
+		}
+	}
+}
+
+// Test that FileServerOptions.AcceptEncodingHeader makes encodings
+// be negotiated from the named header instead of Accept-Encoding.
+func TestServeContentAcceptEncodingHeader(t *testing.T) {
+	h := httpgzip.FileServer(httpfs.New(mapfs.New(map[string]string{"foo.txt": compressibleText})),
+		httpgzip.FileServerOptions{AcceptEncodingHeader: "X-Forwarded-Accept-Encoding"})
+	tests := []struct {
+		acceptEncoding          string
+		forwardedAcceptEncoding string
+		want                    string
+	}{
+		{acceptEncoding: "gzip", forwardedAcceptEncoding: "gzip", want: "gzip"},
+		{acceptEncoding: "", forwardedAcceptEncoding: "gzip", want: "gzip"},
+		{acceptEncoding: "gzip", forwardedAcceptEncoding: "identity", want: ""},
+		{acceptEncoding: "gzip", forwardedAcceptEncoding: "", want: ""},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/foo.txt", nil)
+		req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		if tc.forwardedAcceptEncoding != "" {
+			req.Header.Set("x-forwarded-accept-encoding", tc.forwardedAcceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if got := rr.Header().Get("Content-Encoding"); got != tc.want {
+			t.Errorf("Accept-Encoding %q, X-Forwarded-Accept-Encoding %q: got Content-Encoding %q, want %q", tc.acceptEncoding, tc.forwardedAcceptEncoding, got, tc.want)
+		}
+		if tc.want != "" {
+			if got, want := rr.Header().Get("Vary"), "X-Forwarded-Accept-Encoding"; got != want {
+				t.Errorf("Accept-Encoding %q, X-Forwarded-Accept-Encoding %q: got Vary %q, want %q", tc.acceptEncoding, tc.forwardedAcceptEncoding, got, want)
+			}
+		}
+	}
+}
+
+// Test that FileServerOptions.CompressedByHeader marks responses encoded
+// by ServeContent, and only those.
+func TestServeContentCompressedByHeader(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.br": "precompressed brotli",
+	}))
+	for _, enabled := range []bool{false, true} {
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{CompressedByHeader: enabled})
+		tests := []struct {
+			path           string
+			acceptEncoding string
+			want           string
+		}{
+			{path: "/foo.txt", acceptEncoding: "gzip", want: "httpgzip/gzip"},
+			{path: "/bar.txt", acceptEncoding: "br", want: "httpgzip/br"},
+			{path: "/foo.txt", acceptEncoding: "", want: ""},
+		}
+		for _, tc := range tests {
+			want := tc.want
+			if !enabled {
+				want = ""
+			}
+			rr := serveGet(h, tc.path, tc.acceptEncoding)
+			if got := rr.Header().Get("X-Compressed-By"); got != want {
+				t.Errorf("CompressedByHeader %v, %s with Accept-Encoding %q: got X-Compressed-By %q, want %q", enabled, tc.path, tc.acceptEncoding, got, want)
+			}
+		}
+	}
+
+	// Responses already encoded by the caller aren't marked.
+	h := httpgzip.NewServer(fs, httpgzip.FileServerOptions{CompressedByHeader: true})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	rr.Header().Set("Content-Encoding", "gzip")
+	h.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", strings.NewReader("upstream gzip"))
+	if got, ok := rr.Header()["X-Compressed-By"]; ok {
+		t.Errorf("got X-Compressed-By %q for response encoded by caller, want none", got)
+	}
+}
+
+// Test that content isn't compressed if the Transfer-Encoding header
+// is already set.
+func TestServeContentTransferEncoding(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt.gz": "precompressed gzip",
+	})), httpgzip.FileServerOptions{})
+	req := httptest.NewRequest("GET", "/foo.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	rr.Header().Set("Transfer-Encoding", "chunked")
+	fs.ServeContent(rr, req, "foo.txt", time.Time{}, "/foo.txt", strings.NewReader(compressibleText))
+	if got, ok := rr.Header()["Content-Encoding"]; ok {
+		t.Errorf("got Content-Encoding %q, want none", got)
+	}
+	if got := rr.Body.String(); got != compressibleText {
+		t.Errorf("got body of length %d, want original content of length %d", len(got), len(compressibleText))
+	}
+}
+
+var compressibleText = strings.Repeat("This is some plain text that compresses easily. ", 64)
+
+// Test that a file server can serve a mix of precompressed and dynamically
+// compressed responses concurrently. It's meant to be run with -race.
+func TestServeContentConcurrent(t *testing.T) {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := fstest.MapFS{}
+	want := make(map[string]string) // Keyed by path.
+	for i := 0; i < 4; i++ {
+		content := fmt.Sprintf("file %d: %s", i, compressibleText)
+		files[fmt.Sprintf("dynamic%d.txt", i)] = &fstest.MapFile{Data: []byte(content), ModTime: modTime}
+		files[fmt.Sprintf("precompressed%d.txt", i)] = &fstest.MapFile{Data: []byte(content), ModTime: modTime}
+		files[fmt.Sprintf("precompressed%d.txt.gz", i)] = &fstest.MapFile{Data: gzipBytes(t, content), ModTime: modTime}
+		want[fmt.Sprintf("/dynamic%d.txt", i)] = content
+		want[fmt.Sprintf("/precompressed%d.txt", i)] = content
+	}
+	h := httpgzip.FileServer(http.FS(files), httpgzip.FileServerOptions{
+		PrecompressedCacheSize: 2,
+		ComputeETag:            true,
+		DebugHeader:            true,
+	})
+	var paths []string
+	for path := range want {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path := paths[i%len(paths)]
+			acceptEncoding := []string{"gzip", "identity"}[i/len(paths)%2]
+			rr := serveGet(h, path, acceptEncoding)
+			body := rr.Body.String()
+			if rr.Header().Get("Content-Encoding") == "gzip" {
+				gr, err := gzip.NewReader(rr.Body)
+				if err != nil {
+					t.Errorf("%s with Accept-Encoding %q: %v", path, acceptEncoding, err)
+					return
+				}
+				b, err := ioutil.ReadAll(gr)
+				if err != nil {
+					t.Errorf("%s with Accept-Encoding %q: %v", path, acceptEncoding, err)
+					return
+				}
+				body = string(b)
+			} else if acceptEncoding == "gzip" {
+				t.Errorf("%s with Accept-Encoding %q: got X-Compression %q, want gzip", path, acceptEncoding, rr.Header().Get("X-Compression"))
+			}
+			if body != want[path] {
+				t.Errorf("%s with Accept-Encoding %q: got body %q, want %q", path, acceptEncoding, body, want[path])
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// serveGet serves a GET request for path using h, with
+// the given Accept-Encoding header values, and returns the response.
+func serveGet(h http.Handler, path string, acceptEncoding ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	for _, v := range acceptEncoding {
+		req.Header.Add("Accept-Encoding", v)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
@@ -0,0 +1,118 @@
+package httpgzip
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CompressHandler returns a handler that compresses responses written by next
+// on the fly, using the most preferred registered encoding (see RegisterEncoding)
+// that the request accepts and that supports compression on the fly.
+// Additional optional behaviors can be controlled via opt.
+//
+// Responses that already have a "Content-Encoding" header, and responses smaller
+// than opt.MinSize, are written as is. Error responses are compressed the same
+// way as others, while short ones, such as those written by http.Error, are
+// typically smaller than opt.MinSize. Protocol upgrade requests, such as
+// WebSocket handshakes, are passed on to next with the original ResponseWriter.
+// When CompressHandlers are nested, only the outermost one compresses responses.
+func CompressHandler(next http.Handler, opt CompressHandlerOptions) http.Handler {
+	if opt.MinSize == 0 {
+		opt.MinSize = compressHandlerDefaults.MinSize
+	}
+	if opt.BufferSize == 0 {
+		opt.BufferSize = compressHandlerDefaults.BufferSize
+	}
+	return &compressHandler{next: next, opt: opt}
+}
+
+var compressHandlerDefaults = CompressHandlerOptions{
+	MinSize:    1024,
+	BufferSize: 32 << 10,
+}
+
+// CompressHandlerOptions specifies options for CompressHandler.
+type CompressHandlerOptions struct {
+	// MinSize is the minimum size of a response body, in bytes,
+	// for it to be compressed. If zero, 1024 is used.
+	MinSize int
+
+	// BufferSize is the size of the buffer, in bytes, between writes of
+	// a response body and its compression. Larger buffers make for fewer,
+	// larger writes to the compressor, such as for bulk downloads, while
+	// smaller ones use less memory per response. Buffered data is written
+	// out when the buffer fills, when the response is flushed via http.Flusher,
+	// and when it's complete, so streamed responses that flush after each
+	// message aren't delayed by it. If zero, 32 KiB is used. If negative,
+	// writes aren't buffered.
+	BufferSize int
+
+	// Stats, if not nil, is called once each compressed response
+	// has been written, with statistics about its compression.
+	// It's not called for responses that are passed through,
+	// such as protocol upgrades.
+	Stats func(req *http.Request, stats CompressionStats)
+}
+
+type compressHandler struct {
+	next http.Handler
+	opt  CompressHandlerOptions
+}
+
+func (h *compressHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if isUpgrade(req) {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	if req.Context().Value(compressingContextKey) != nil {
+		// An enclosing CompressHandler is already compressing this response.
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	req = req.WithContext(context.WithValue(req.Context(), compressingContextKey, true))
+	cw := compressWriterPool.Get().(*CompressWriter)
+	cw.Reset(w, req)
+	cw.minSize = h.opt.MinSize
+	cw.bufferSize = h.opt.BufferSize
+	defer func() {
+		cw.Close()
+		if h.opt.Stats != nil {
+			h.opt.Stats(req, cw.Stats())
+		}
+		cw.Reset(nil, nil)
+		compressWriterPool.Put(cw)
+	}()
+	h.next.ServeHTTP(cw, req)
+}
+
+var compressWriterPool = sync.Pool{
+	New: func() interface{} { return new(CompressWriter) },
+}
+
+// contextKey is a value for use with context.WithValue.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "httpgzip context value " + k.name }
+
+// compressingContextKey is a context key set by CompressHandler
+// on requests whose responses it compresses.
+var compressingContextKey = &contextKey{"compressing"}
+
+// isUpgrade reports whether req asks to upgrade the connection to another protocol.
+func isUpgrade(req *http.Request) bool {
+	if _, ok := req.Header["Upgrade"]; ok {
+		return true
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
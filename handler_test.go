@@ -0,0 +1,339 @@
+package httpgzip_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/httpgzip"
+)
+
+func TestCompressHandler(t *testing.T) {
+	h := httpgzip.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/large":
+			io.WriteString(w, compressibleText)
+		case "/small":
+			io.WriteString(w, "Hello world")
+		}
+	}), httpgzip.CompressHandlerOptions{})
+
+	rr := serveGet(h, "/large", "gzip")
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("got Content-Encoding %q, want %q", got, want)
+	}
+	if got, want := rr.Header().Get("Vary"), "Accept-Encoding"; got != want {
+		t.Errorf("got Vary %q, want %q", got, want)
+	}
+	if got, want := rr.Header().Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+	gr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != compressibleText {
+		t.Errorf("got decompressed body %q, want original content", b)
+	}
+
+	// Small responses and requests that don't accept gzip are written as is.
+	for _, tc := range []struct {
+		path           string
+		acceptEncoding string
+		want           string
+	}{
+		{path: "/small", acceptEncoding: "gzip", want: "Hello world"},
+		{path: "/large", acceptEncoding: "identity", want: compressibleText},
+	} {
+		rr := serveGet(h, tc.path, tc.acceptEncoding)
+		if got, ok := rr.Header()["Content-Encoding"]; ok {
+			t.Errorf("%s with Accept-Encoding %q: got Content-Encoding %q, want none", tc.path, tc.acceptEncoding, got)
+		}
+		if got := rr.Body.String(); got != tc.want {
+			t.Errorf("%s with Accept-Encoding %q: got body %q, want %q", tc.path, tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+// Test that error responses are compressed like any other,
+// as long as they're not smaller than the minimum size.
+func TestCompressHandlerErrorResponses(t *testing.T) {
+	h := httpgzip.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, compressibleText)
+		case "/small":
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		}
+	}), httpgzip.CompressHandlerOptions{})
+
+	rr := serveGet(h, "/large", "gzip")
+	if got, want := rr.Code, http.StatusNotFound; got != want {
+		t.Errorf("/large: got status %v, want %v", got, want)
+	}
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("/large: got Content-Encoding %q, want %q", got, want)
+	}
+	gr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(gr); err != nil || string(b) != compressibleText {
+		t.Errorf("/large: got decompressed body of length %d and error %v, want original content", len(b), err)
+	}
+
+	rr = serveGet(h, "/small", "gzip")
+	if got, want := rr.Code, http.StatusInternalServerError; got != want {
+		t.Errorf("/small: got status %v, want %v", got, want)
+	}
+	if got, ok := rr.Header()["Content-Encoding"]; ok {
+		t.Errorf("/small: got Content-Encoding %q, want none", got)
+	}
+	if got, want := rr.Body.String(), "500 Internal Server Error\n"; got != want {
+		t.Errorf("/small: got body %q, want %q", got, want)
+	}
+}
+
+// Test that responses are compressed correctly regardless of
+// CompressHandlerOptions.BufferSize, and that flushing writes out
+// data buffered before compression.
+func TestCompressHandlerBufferSize(t *testing.T) {
+	for _, bufferSize := range []int{-1, 0, 16, 1 << 20} {
+		rr := httptest.NewRecorder()
+		var flushed string // Decompressed body written out by the time of the flush.
+		h := httpgzip.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			for s := compressibleText; s != ""; {
+				n := 7
+				if n > len(s) {
+					n = len(s)
+				}
+				io.WriteString(w, s[:n])
+				s = s[n:]
+			}
+			w.(http.Flusher).Flush()
+			gr, err := gzip.NewReader(bytes.NewReader(rr.Body.Bytes()))
+			if err != nil {
+				t.Errorf("BufferSize %d: after flush: %v", bufferSize, err)
+				return
+			}
+			b := make([]byte, len(compressibleText))
+			n, _ := io.ReadFull(gr, b)
+			flushed = string(b[:n])
+			io.WriteString(w, "end")
+		}), httpgzip.CompressHandlerOptions{BufferSize: bufferSize})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(rr, req)
+
+		if flushed != compressibleText {
+			t.Errorf("BufferSize %d: got %d bytes written out by flush, want %d", bufferSize, len(flushed), len(compressibleText))
+		}
+		gr, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("BufferSize %d: %v", bufferSize, err)
+		}
+		b, err := ioutil.ReadAll(gr)
+		if err != nil {
+			t.Fatalf("BufferSize %d: %v", bufferSize, err)
+		}
+		if got, want := string(b), compressibleText+"end"; got != want {
+			t.Errorf("BufferSize %d: got decompressed body of %d bytes, want %d", bufferSize, len(got), len(want))
+		}
+	}
+}
+
+// Test that partial responses to range requests aren't compressed,
+// and that compressed responses don't advertise range support.
+func TestCompressHandlerRanges(t *testing.T) {
+	h := httpgzip.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Vary", "Accept-Encoding")
+		http.ServeContent(w, req, "foo.txt", time.Time{}, strings.NewReader(compressibleText))
+	}), httpgzip.CompressHandlerOptions{})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-1999")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if got, want := rr.Code, http.StatusPartialContent; got != want {
+		t.Fatalf("range request: got status %d, want %d", got, want)
+	}
+	if got := rr.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("range request: got Content-Encoding %q, want none", got)
+	}
+	if got, want := rr.Body.String(), compressibleText[:2000]; got != want {
+		t.Errorf("range request: got body of %d bytes, want first %d bytes of content", len(got), len(want))
+	}
+
+	rr = serveGet(h, "/", "gzip")
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Errorf("got Content-Encoding %q, want %q", got, want)
+	}
+	if got, ok := rr.Header()["Accept-Ranges"]; ok {
+		t.Errorf("got Accept-Ranges %q, want none", got)
+	}
+	if got, want := rr.Header()["Vary"], []string{"Accept-Encoding"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got Vary %q, want %q", got, want)
+	}
+}
+
+// Test that responses to HEAD requests, whose body isn't written,
+// have the same headers as responses to GET requests.
+func TestCompressHandlerHead(t *testing.T) {
+	h := httpgzip.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		content := compressibleText
+		if req.URL.Path == "/small" {
+			content = "Hello world"
+		}
+		http.ServeContent(w, req, "foo.txt", time.Time{}, strings.NewReader(content))
+	}), httpgzip.CompressHandlerOptions{})
+
+	for _, path := range []string{"/", "/small"} {
+		get := serveGet(h, path, "gzip")
+		req := httptest.NewRequest("HEAD", path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		head := httptest.NewRecorder()
+		h.ServeHTTP(head, req)
+		if got, want := head.Header(), get.Header(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got HEAD headers %v, want GET headers %v", path, got, want)
+		}
+		if head.Body.Len() != 0 {
+			t.Errorf("%s: got HEAD body of %d bytes, want none", path, head.Body.Len())
+		}
+	}
+}
+
+// Test that CompressHandlerOptions.Stats is called once per response
+// with statistics about its compression.
+func TestCompressHandlerStats(t *testing.T) {
+	var got []httpgzip.CompressionStats
+	h := httpgzip.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/streamed":
+			for i := 0; i < 3; i++ {
+				io.WriteString(w, compressibleText)
+				w.(http.Flusher).Flush()
+			}
+		case "/small":
+			io.WriteString(w, "Hello world")
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "gzip")
+			io.WriteString(w, compressibleText)
+		}
+	}), httpgzip.CompressHandlerOptions{
+		Stats: func(req *http.Request, stats httpgzip.CompressionStats) { got = append(got, stats) },
+	})
+
+	rr := serveGet(h, "/streamed", "gzip")
+	if len(got) != 1 {
+		t.Fatalf("/streamed: Stats called %d times, want 1", len(got))
+	}
+	s := got[0]
+	if s.Encoding != "gzip" || s.Source != "dynamic" || s.Flushes != 3 {
+		t.Errorf("/streamed: got Encoding %q, Source %q, Flushes %d; want gzip, dynamic, 3", s.Encoding, s.Source, s.Flushes)
+	}
+	if want := int64(3 * len(compressibleText)); s.BytesIn != want {
+		t.Errorf("/streamed: got BytesIn %d, want %d", s.BytesIn, want)
+	}
+	if want := int64(rr.Body.Len()); s.BytesOut != want {
+		t.Errorf("/streamed: got BytesOut %d, want %d", s.BytesOut, want)
+	}
+
+	got = nil
+	serveGet(h, "/small", "gzip")
+	if len(got) != 1 {
+		t.Fatalf("/small: Stats called %d times, want 1", len(got))
+	}
+	if want := (httpgzip.CompressionStats{Encoding: "identity", Source: "identity", BytesIn: 11, BytesOut: 11, Duration: got[0].Duration}); got[0] != want {
+		t.Errorf("/small: got stats %+v, want %+v", got[0], want)
+	}
+
+	got = nil
+	serveGet(h, "/encoded", "gzip")
+	if len(got) != 1 {
+		t.Fatalf("/encoded: Stats called %d times, want 1", len(got))
+	}
+	n := int64(len(compressibleText))
+	if want := (httpgzip.CompressionStats{Encoding: "gzip", Source: "precompressed", BytesIn: n, BytesOut: n, Duration: got[0].Duration}); got[0] != want {
+		t.Errorf("/encoded: got stats %+v, want %+v", got[0], want)
+	}
+}
+
+// Test that protocol upgrade requests are passed through, and that connections
+// can be hijacked through CompressHandler.
+func TestCompressHandlerHijack(t *testing.T) {
+	ts := httptest.NewServer(httpgzip.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\nhijacked")
+		rw.Flush()
+	}), httpgzip.CompressHandlerOptions{}))
+	defer ts.Close()
+
+	for _, upgrade := range []bool{true, false} {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		if upgrade {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "test")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := resp.StatusCode, http.StatusSwitchingProtocols; got != want {
+			t.Errorf("upgrade %v: got status %d, want %d", upgrade, got, want)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), "hijacked"; got != want {
+			t.Errorf("upgrade %v: got body %q, want %q", upgrade, got, want)
+		}
+	}
+}
+
+// Test that nested CompressHandlers compress the response only once.
+func TestCompressHandlerNested(t *testing.T) {
+	h := httpgzip.CompressHandler(httpgzip.CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, compressibleText)
+	}), httpgzip.CompressHandlerOptions{}), httpgzip.CompressHandlerOptions{})
+
+	rr := serveGet(h, "/", "gzip")
+	if got, want := rr.Header()["Content-Encoding"], []string{"gzip"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got Content-Encoding %q, want %q", got, want)
+	}
+	gr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != compressibleText {
+		t.Errorf("got body decompressed once %q, want original content", b)
+	}
+}
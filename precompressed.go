@@ -1,10 +1,22 @@
 package httpgzip
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-func (fs *fileServer) maybeFindFile(fpath string) http.File {
+func (fs *Server) maybeFindFile(fpath string) http.File {
 	if file, err := fs.root.Open(fpath); err == nil {
 		return file
 	}
@@ -12,10 +24,279 @@ func (fs *fileServer) maybeFindFile(fpath string) http.File {
 	return nil
 }
 
-func (fs *fileServer) maybeFindBrotliFile(fpath string) http.File {
-	return fs.maybeFindFile(fpath + ".br")
+// maybeFindBrotliFile returns the first precompressed Brotli variant of fpath
+// that exists, trying suffixes in the order of FileServerOptions.BrotliSuffixes,
+// along with its path.
+func (fs *Server) maybeFindBrotliFile(fpath string) (string, http.File) {
+	for _, suffix := range fs.opt.BrotliSuffixes {
+		if file := fs.maybeFindFile(fpath + suffix); file != nil {
+			return fpath + suffix, file
+		}
+	}
+	return "", nil
+}
+
+// cleanPath returns fpath cleaned and made absolute, and reports whether it
+// stays within the root of the file system. It doesn't if any ".." element
+// refers to above the root, or if it contains a separator other than '/',
+// since variants next to such paths could be outside of the root.
+// If it returns false, the returned path is fpath unmodified.
+func cleanPath(fpath string) (string, bool) {
+	if filepath.Separator != '/' && strings.ContainsRune(fpath, filepath.Separator) || strings.ContainsRune(fpath, 0) {
+		return fpath, false
+	}
+	depth := 0
+	for _, elem := range strings.Split(fpath, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if depth == 0 {
+				return fpath, false
+			}
+			depth--
+		default:
+			depth++
+		}
+	}
+	return path.Clean("/" + fpath), true
+}
+
+// maybeFindVariant returns a precompressed variant of fpath encoded with enc,
+// either from the root file system or FileServerOptions.PrecompressCacheDir,
+// if one exists. modTime is the modification time of the file at fpath.
+// It's not looked for if enc is in FileServerOptions.DisabledPrecompressed.
+func (fs *Server) maybeFindVariant(enc Encoding, fpath string, modTime time.Time) http.File {
+	if isNamed(enc, fs.opt.DisabledPrecompressed) {
+		return nil
+	}
+	if file := fs.maybeFindPrecompressedFile(enc, fpath, modTime); file != nil {
+		return file
+	}
+	return fs.maybeFindCachedFile(enc, fpath, modTime)
+}
+
+// maybeFindPrecompressedFile returns a precompressed variant of fpath
+// encoded with enc, if one exists. modTime is the modification time of
+// the file at fpath, which is used to invalidate cached lookups.
+func (fs *Server) maybeFindPrecompressedFile(enc Encoding, fpath string, modTime time.Time) http.File {
+	if fs.precompressed == nil || modTime.IsZero() {
+		_, file := fs.findPrecompressedFile(enc, fpath)
+		return file
+	}
+	key := precompressedKey{encoding: enc.Name(), fpath: fpath}
+	if e, ok := fs.precompressed.get(key); ok && e.modTime.Equal(modTime) {
+		if e.path == "" {
+			return nil
+		}
+		if file := fs.maybeFindFile(e.path); file != nil {
+			return file
+		}
+	}
+	path, file := fs.findPrecompressedFile(enc, fpath)
+	fs.precompressed.put(key, precompressedEntry{path: path, modTime: modTime})
+	return file
+}
+
+// findPrecompressedFile returns a precompressed variant of fpath
+// encoded with enc, along with its path, if one exists.
+func (fs *Server) findPrecompressedFile(enc Encoding, fpath string) (string, http.File) {
+	if enc.Name() == "br" {
+		// Brotli variants are looked up using FileServerOptions.BrotliSuffixes.
+		return fs.maybeFindBrotliFile(fpath)
+	}
+	if path := enc.FindPrecompressed(fpath); path != "" {
+		if file := fs.maybeFindFile(path); file != nil {
+			return path, file
+		}
+	}
+	return "", nil
+}
+
+// cachedPath returns the path within FileServerOptions.PrecompressCacheDir
+// of the variant of fpath encoded with enc. It reports false if enc doesn't
+// support precompressed variants, so there's no path to store them at.
+func (fs *Server) cachedPath(enc Encoding, fpath string) (string, bool) {
+	variant := enc.FindPrecompressed(fpath)
+	if variant == "" {
+		return "", false
+	}
+	return filepath.Join(fs.opt.PrecompressCacheDir, filepath.FromSlash(path.Clean("/"+variant))), true
+}
+
+// maybeFindCachedFile returns the variant of fpath encoded with enc
+// from FileServerOptions.PrecompressCacheDir, if one exists and was written
+// for the file at fpath with modification time modTime.
+func (fs *Server) maybeFindCachedFile(enc Encoding, fpath string, modTime time.Time) http.File {
+	if fs.opt.PrecompressCacheDir == "" || modTime.IsZero() {
+		return nil
+	}
+	cached, ok := fs.cachedPath(enc, fpath)
+	if !ok {
+		return nil
+	}
+	file, err := os.Open(cached)
+	if err != nil {
+		return nil
+	}
+	if fi, err := file.Stat(); err != nil || !fi.ModTime().Equal(modTime) {
+		file.Close()
+		return nil
+	}
+	return file
+}
+
+// writeCachedFile persists compressed, the variant of fpath encoded with enc,
+// to FileServerOptions.PrecompressCacheDir. It's written to a temporary file
+// that's renamed into place, so partially written variants are never served.
+// The variant is given the modification time of the file at fpath, modTime.
+func (fs *Server) writeCachedFile(enc Encoding, fpath string, modTime time.Time, compressed []byte) error {
+	if fs.opt.PrecompressCacheDir == "" || modTime.IsZero() {
+		return nil
+	}
+	dst, ok := fs.cachedPath(enc, fpath)
+	if !ok {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dst), ".httpgzip-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // No-op once renamed.
+	_, err = f.Write(compressed)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(f.Name(), modTime, modTime); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dst)
+}
+
+// precompressedCache is a bounded cache of precompressed variant lookups.
+type precompressedCache struct {
+	max int
+
+	mu      sync.Mutex
+	entries map[precompressedKey]precompressedEntry
+}
+
+type precompressedKey struct {
+	encoding string // Name of the encoding of the variant.
+	fpath    string // Path of the original file.
+}
+
+type precompressedEntry struct {
+	path    string    // Path of the variant, or "" if there's none.
+	modTime time.Time // Modification time of the original file at time of lookup.
+}
+
+func newPrecompressedCache(max int) *precompressedCache {
+	return &precompressedCache{max: max, entries: make(map[precompressedKey]precompressedEntry)}
+}
+
+func (c *precompressedCache) get(key precompressedKey) (precompressedEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+// put adds an entry to the cache. If the cache is full, an arbitrary
+// entry is evicted to make room for it.
+func (c *precompressedCache) put(key precompressedKey, e precompressedEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = e
+}
+
+// gzipMagic are the first bytes of gzip data, as defined by RFC 1952, section 2.3.1.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// verifyPrecompressed checks that file, a precompressed variant encoded
+// with enc, looks like valid data of that encoding, and rewinds it to the start.
+// Only gzip variants are checked; variants of other encodings are assumed valid.
+func verifyPrecompressed(enc Encoding, file io.ReadSeeker) error {
+	if enc.Name() != "gzip" {
+		return nil
+	}
+	ok, err := hasGzipMagic(file)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("missing gzip header")
+	}
+	return nil
+}
+
+// verifyPrecompressedIntegrity checks that file, a precompressed variant
+// of fpath encoded with enc, decompresses to size bytes without errors,
+// and rewinds it to the start. Only gzip variants are checked. The result is
+// remembered while the variant keeps the same non-zero modification time.
+func (fs *Server) verifyPrecompressedIntegrity(enc Encoding, fpath string, file http.File, size int64) error {
+	if enc.Name() != "gzip" {
+		return nil
+	}
+	key := precompressedKey{encoding: enc.Name(), fpath: fpath}
+	var modTime time.Time
+	if fi, err := file.Stat(); err == nil {
+		modTime = fi.ModTime()
+	}
+	if v, ok := fs.verified.Load(key); ok && !modTime.IsZero() && v.(time.Time).Equal(modTime) {
+		return nil
+	}
+	err := verifyGzipIntegrity(file, size)
+	if err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		fs.verified.Store(key, modTime)
+	}
+	return nil
 }
 
-func (fs *fileServer) maybeFindGzipFile(fpath string) http.File {
-	return fs.maybeFindFile(fpath + ".gz")
+// verifyGzipIntegrity checks that r is a gzip stream that decompresses to
+// size bytes, with intact checksums, and rewinds it to the start.
+// It stops decompressing once more than size bytes have been decompressed.
+func verifyGzipIntegrity(r io.ReadSeeker, size int64) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(ioutil.Discard, &maxBytesReader{r: zr, remaining: size + 1})
+	if err == errTooLarge {
+		return fmt.Errorf("decompresses to more than original size %d", size)
+	} else if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("decompresses to %d bytes, want original size %d", n, size)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return err
+}
+
+// hasGzipMagic reports whether r begins with the gzip header magic bytes,
+// and rewinds it to the start.
+func hasGzipMagic(r io.ReadSeeker) (bool, error) {
+	var magic [2]byte
+	_, err := io.ReadFull(r, magic[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	ok := err == nil && bytes.Equal(magic[:], gzipMagic)
+	_, err = r.Seek(0, io.SeekStart)
+	return ok, err
 }
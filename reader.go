@@ -0,0 +1,68 @@
+package httpgzip
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ServeReader serves content with DefaultFileServer.
+// See (*Server).ServeReader.
+func ServeReader(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.Reader) {
+	DefaultFileServer.ServeReader(w, req, name, modTime, fpath, content)
+}
+
+// ServeReader is like ServeContent, except content doesn't need to support
+// seeking. If it doesn't, content is read into memory, so that it can be
+// served by ServeContent. If content is larger than
+// FileServerOptions.MaxReaderBufferSize, what was read is served followed
+// by the rest of content, streamed without compression and without support
+// for range requests. Like ServeContent, ServeReader doesn't close content.
+func (fs *Server) ServeReader(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.Reader) {
+	fs.serveReader(w, req, name, modTime, fpath, content, false)
+}
+
+// serveReader is like ServeReader. fromRoot is as for serveContent.
+func (fs *Server) serveReader(w http.ResponseWriter, req *http.Request, name string, modTime time.Time, fpath string, content io.Reader, fromRoot bool) {
+	if rs, ok := content.(io.ReadSeeker); ok {
+		fs.serveContent(w, req, name, modTime, fpath, rs, fromRoot)
+		return
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(content, fs.opt.MaxReaderBufferSize+1))
+	if err != nil {
+		fs.opt.ErrorHandler(w, req, &ContentError{Op: "read", Err: err})
+		return
+	}
+	if int64(len(buf)) <= fs.opt.MaxReaderBufferSize {
+		fs.serveContent(w, req, name, modTime, fpath, bytes.NewReader(buf), fromRoot)
+		return
+	}
+
+	// Too large to buffer, stream it as is.
+	if checkLastModified(w, req, modTime) {
+		return
+	}
+	h := w.Header()
+	if _, haveType := h["Content-Type"]; !haveType {
+		ctype, _, _ := fs.contentType(typeName(name, fpath), func() (string, error) {
+			if len(buf) > sniffLen {
+				return http.DetectContentType(buf[:sniffLen]), nil
+			}
+			return http.DetectContentType(buf), nil
+		})
+		h.Set("Content-Type", ctype)
+	}
+	encoding := strings.Join(contentCodings(h), ", ")
+	if encoding == "" {
+		encoding = "identity"
+	}
+	fs.stats.served(encoding)
+	fs.serveHook(w, req, encoding)
+	w.WriteHeader(http.StatusOK)
+	if req.Method != "HEAD" {
+		io.Copy(w, io.MultiReader(bytes.NewReader(buf), content))
+	}
+}
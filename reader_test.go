@@ -0,0 +1,58 @@
+package httpgzip_test
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shurcooL/httpgzip"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// Test that ServeReader compresses content that doesn't support seeking,
+// and streams content larger than FileServerOptions.MaxReaderBufferSize
+// without compression.
+func TestServeReader(t *testing.T) {
+	tests := []struct {
+		maxReaderBufferSize int64
+		wantEncoding        string
+	}{
+		{maxReaderBufferSize: 0, wantEncoding: "gzip"},
+		{maxReaderBufferSize: int64(len(compressibleText)), wantEncoding: "gzip"},
+		{maxReaderBufferSize: 100, wantEncoding: ""},
+	}
+	for _, tc := range tests {
+		fs := httpgzip.NewServer(httpfs.New(mapfs.New(nil)), httpgzip.FileServerOptions{MaxReaderBufferSize: tc.maxReaderBufferSize})
+		pr, pw := io.Pipe()
+		go func() {
+			io.WriteString(pw, compressibleText)
+			pw.Close()
+		}()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		fs.ServeReader(rr, req, "foo.txt", time.Time{}, "/foo.txt", pr)
+
+		if got := rr.Header().Get("Content-Encoding"); got != tc.wantEncoding {
+			t.Errorf("MaxReaderBufferSize %d: got Content-Encoding %q, want %q", tc.maxReaderBufferSize, got, tc.wantEncoding)
+		}
+		if got, want := rr.Header().Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+			t.Errorf("MaxReaderBufferSize %d: got Content-Type %q, want %q", tc.maxReaderBufferSize, got, want)
+		}
+		var body io.Reader = rr.Body
+		if tc.wantEncoding == "gzip" {
+			gr, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = gr
+		}
+		if got, err := ioutil.ReadAll(body); err != nil || string(got) != compressibleText {
+			t.Errorf("MaxReaderBufferSize %d: got body of length %d and error %v, want original content of length %d", tc.maxReaderBufferSize, len(got), err, len(compressibleText))
+		}
+	}
+}
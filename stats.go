@@ -0,0 +1,66 @@
+package httpgzip
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// EncodingStats are cumulative statistics about the responses
+// served by a file server, as returned by its Stats method.
+type EncodingStats struct {
+	// Requests is the number of responses served, keyed by the name of
+	// the encoding they were served with, or "identity" if not encoded.
+	Requests map[string]int64
+
+	// BytesSaved is the total number of bytes saved by serving encoded
+	// content instead of the original, whether precompressed or not.
+	BytesSaved int64
+
+	// PrecompressedHits and PrecompressedMisses are the number of responses
+	// to requests accepting encodings for which a precompressed variant
+	// of the file was and wasn't found, respectively.
+	PrecompressedHits   int64
+	PrecompressedMisses int64
+
+	// Aborted is the number of responses that couldn't be written in full,
+	// such as because the client disconnected partway. For those compressed
+	// on the fly, the compression was wasted.
+	Aborted int64
+}
+
+// fileServerStats are the counters behind EncodingStats.
+// They're updated atomically, so that they don't contend under load.
+type fileServerStats struct {
+	requests            sync.Map // Encoding name -> *atomic.Int64.
+	bytesSaved          atomic.Int64
+	precompressedHits   atomic.Int64
+	precompressedMisses atomic.Int64
+	aborted             atomic.Int64
+}
+
+// served records that a response was served with the named encoding.
+func (s *fileServerStats) served(encoding string) {
+	n, ok := s.requests.Load(encoding)
+	if !ok {
+		n, _ = s.requests.LoadOrStore(encoding, new(atomic.Int64))
+	}
+	n.(*atomic.Int64).Add(1)
+}
+
+// Stats returns a snapshot of cumulative statistics about the responses
+// fs has served, such as for exposing on a debug endpoint.
+// It's safe to call concurrently with serving requests.
+func (fs *Server) Stats() EncodingStats {
+	stats := EncodingStats{
+		Requests:            make(map[string]int64),
+		BytesSaved:          fs.stats.bytesSaved.Load(),
+		PrecompressedHits:   fs.stats.precompressedHits.Load(),
+		PrecompressedMisses: fs.stats.precompressedMisses.Load(),
+		Aborted:             fs.stats.aborted.Load(),
+	}
+	fs.stats.requests.Range(func(k, v interface{}) bool {
+		stats.Requests[k.(string)] = v.(*atomic.Int64).Load()
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,95 @@
+package httpgzip_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/shurcooL/httpgzip"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// Test that Stats counts the responses served concurrently by a file server.
+func TestFileServerStats(t *testing.T) {
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":    compressibleText,
+		"bar.txt":    compressibleText,
+		"bar.txt.gz": "precompressed gzip",
+	})), httpgzip.FileServerOptions{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveGet(fs, "/foo.txt")
+			serveGet(fs, "/foo.txt", "gzip")
+			serveGet(fs, "/bar.txt", "gzip")
+		}()
+	}
+	wg.Wait()
+
+	stats := fs.Stats()
+	if want := map[string]int64{"identity": 10, "gzip": 20}; !reflect.DeepEqual(stats.Requests, want) {
+		t.Errorf("got Requests %v, want %v", stats.Requests, want)
+	}
+	if stats.PrecompressedHits != 10 || stats.PrecompressedMisses != 10 {
+		t.Errorf("got PrecompressedHits %d and PrecompressedMisses %d, want 10 and 10", stats.PrecompressedHits, stats.PrecompressedMisses)
+	}
+	gzipped := serveGet(fs, "/foo.txt", "gzip").Body.Len()
+	if want := 10 * int64(2*len(compressibleText)-gzipped-len("precompressed gzip")); stats.BytesSaved != want {
+		t.Errorf("got BytesSaved %d, want %d", stats.BytesSaved, want)
+	}
+}
+
+// Test that responses that couldn't be written in full are counted
+// in Stats and reported to FileServerOptions.AbortHook.
+func TestFileServerStatsAborted(t *testing.T) {
+	var aborted []string
+	fs := httpgzip.NewServer(httpfs.New(mapfs.New(map[string]string{
+		"foo.txt": compressibleText,
+	})), httpgzip.FileServerOptions{
+		AbortHook: func(req *http.Request, encoding string, err error) {
+			if err != errDisconnected {
+				t.Errorf("AbortHook: got error %v, want %v", err, errDisconnected)
+			}
+			aborted = append(aborted, encoding)
+		},
+	})
+	for _, acceptEncoding := range []string{"gzip", "identity"} {
+		req := httptest.NewRequest("GET", "/foo.txt", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		fs.ServeHTTP(&disconnectingWriter{ResponseRecorder: httptest.NewRecorder(), n: 10}, req)
+	}
+	serveGet(fs, "/foo.txt", "gzip") // Written in full.
+
+	if got, want := fs.Stats().Aborted, int64(2); got != want {
+		t.Errorf("got Aborted %d, want %d", got, want)
+	}
+	if want := []string{"gzip", "identity"}; !reflect.DeepEqual(aborted, want) {
+		t.Errorf("got AbortHook calls for %q, want %q", aborted, want)
+	}
+}
+
+var errDisconnected = errors.New("client disconnected")
+
+// disconnectingWriter is an http.ResponseWriter that fails
+// to write body bytes after the first n.
+type disconnectingWriter struct {
+	*httptest.ResponseRecorder
+	n int
+}
+
+func (w *disconnectingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n, _ := w.ResponseRecorder.Write(p[:w.n])
+		w.n = 0
+		return n, errDisconnected
+	}
+	w.n -= len(p)
+	return w.ResponseRecorder.Write(p)
+}
@@ -0,0 +1,356 @@
+package httpgzip
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CompressWriter is an http.ResponseWriter that compresses the response body
+// written to it. On the first write, it negotiates the most preferred registered
+// encoding that the request accepts and that supports compression on the fly.
+// Responses that already have a "Content-Encoding" header are written as is.
+//
+// The zero value is not usable, use NewCompressWriter or Reset to initialize it.
+// After the response has been written, Close must be called, which releases
+// resources used for compression; writes after Close fail.
+// CompressWriters can be reused via Reset, such as with a sync.Pool.
+type CompressWriter struct {
+	rw      http.ResponseWriter
+	encs    []Encoding // Acceptable encodings, in order of preference.
+	minSize int        // Minimum size of body to compress. Writes are buffered until it's reached.
+	head    bool       // Whether the request is a HEAD request, whose body isn't written.
+
+	// bufferSize is the size of the buffer between writes to cw and
+	// the compressing writer, or 0 if writes aren't buffered.
+	bufferSize int
+	bw         *bufio.Writer // Buffers writes to w, if bufferSize > 0. Kept across Reset.
+
+	status      int    // Status code passed to WriteHeader.
+	buf         []byte // Body written before deciding whether to compress.
+	decided     bool   // Whether it's been decided whether to compress.
+	hijacked    bool
+	closed      bool
+	w           io.WriteCloser // Compressing writer, if compressing.
+	encoding    string         // Name of the encoding, if compressing or already encoded.
+	encoded     bool           // Whether the response was already encoded by the handler.
+	wroteHeader bool
+
+	start    time.Time     // Time of Reset.
+	duration time.Duration // Time from Reset to Close.
+	bytesIn  int64         // Bytes of body written to cw.
+	bytesOut int64         // Bytes of body written to rw.
+	flushes  int
+}
+
+// CompressionStats describes how a response was compressed.
+type CompressionStats struct {
+	Encoding string        // Name of the encoding, or "identity" if not compressed.
+	Source   string        // "precompressed" if encoded by the handler, "dynamic" or "identity".
+	BytesIn  int64         // Size of the response body before compression.
+	BytesOut int64         // Size of the response body after compression.
+	Flushes  int           // Number of times the response was flushed.
+	Duration time.Duration // Time taken to write the response.
+}
+
+// NewCompressWriter returns a CompressWriter that writes
+// a compressed response to w for request req.
+func NewCompressWriter(w http.ResponseWriter, req *http.Request) *CompressWriter {
+	cw := new(CompressWriter)
+	cw.Reset(w, req)
+	return cw
+}
+
+// Reset discards the state of cw and makes it equivalent to the result
+// of NewCompressWriter(w, req). Close should be called before Reset
+// if cw was previously in use.
+func (cw *CompressWriter) Reset(w http.ResponseWriter, req *http.Request) {
+	var encs []Encoding
+	var head bool
+	if req != nil {
+		encs = negotiate(req.Header["Accept-Encoding"], registeredEncodings(), nil, false)
+		head = req.Method == http.MethodHead
+	}
+	*cw = CompressWriter{
+		rw:     w,
+		encs:   encs,
+		head:   head,
+		status: http.StatusOK,
+		buf:    cw.buf[:0],
+		bw:     cw.bw,
+		start:  time.Now(),
+	}
+	if cw.bw != nil {
+		cw.bw.Reset(nil)
+	}
+}
+
+// Stats returns statistics about how the response was compressed.
+// They're complete once Close has been called.
+func (cw *CompressWriter) Stats() CompressionStats {
+	stats := CompressionStats{
+		Encoding: "identity",
+		Source:   "identity",
+		BytesIn:  cw.bytesIn,
+		BytesOut: cw.bytesOut,
+		Flushes:  cw.flushes,
+		Duration: cw.duration,
+	}
+	if cw.w != nil {
+		stats.Encoding, stats.Source = cw.encoding, "dynamic"
+	} else if cw.encoded {
+		stats.Encoding, stats.Source = cw.encoding, "precompressed"
+	}
+	return stats
+}
+
+// Header implements http.ResponseWriter.
+func (cw *CompressWriter) Header() http.Header { return cw.rw.Header() }
+
+// WriteHeader implements http.ResponseWriter.
+func (cw *CompressWriter) WriteHeader(code int) {
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		// Informational responses precede the final one, pass them on.
+		cw.rw.WriteHeader(code)
+		return
+	}
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = code
+	if !bodyAllowed(code) {
+		cw.decide(false)
+	}
+}
+
+// Write implements http.ResponseWriter and io.Writer.
+func (cw *CompressWriter) Write(p []byte) (int, error) {
+	if cw.closed {
+		return 0, errWriteAfterClose
+	}
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	cw.bytesIn += int64(len(p))
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) >= cw.minSize {
+			if err := cw.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	if cw.w != nil {
+		return cw.compressor().Write(p)
+	}
+	return cw.writeOut(p)
+}
+
+// compressor returns the writer that the body is written to when compressing,
+// which buffers writes to the compressing writer if bufferSize > 0.
+func (cw *CompressWriter) compressor() io.Writer {
+	if cw.bufferSize > 0 {
+		return cw.bw
+	}
+	return cw.w
+}
+
+// writeOut writes p to the underlying ResponseWriter. The framing
+// of an empty compressed body of a HEAD response is dropped.
+func (cw *CompressWriter) writeOut(p []byte) (int, error) {
+	if cw.head && cw.bytesIn == 0 {
+		return len(p), nil
+	}
+	n, err := cw.rw.Write(p)
+	cw.bytesOut += int64(n)
+	return n, err
+}
+
+// decide decides whether to compress the response, writes the response header,
+// and writes out anything buffered so far. Compression is only applied if
+// compressible is true, and an acceptable encoding can compress on the fly.
+// Partial responses to range requests aren't compressed, since their ranges
+// address the bytes of the uncompressed representation.
+func (cw *CompressWriter) decide(compressible bool) error {
+	cw.decided = true
+	h := cw.Header()
+	if _, ok := h["Content-Encoding"]; ok || !bodyAllowed(cw.status) {
+		compressible = false
+	}
+	if codings := contentCodings(h); len(codings) > 0 {
+		cw.encoding, cw.encoded = strings.Join(codings, ", "), true
+	}
+	if _, ok := h["Content-Range"]; ok || cw.status == http.StatusPartialContent {
+		compressible = false
+	}
+	if compressible {
+		for _, enc := range cw.encs {
+			if isGzipEncoding(enc) {
+				// Gzip writers are expensive to create, so they're pooled,
+				// and returned to their pool by Close.
+				cw.w = newGzipWriter(writerFunc(cw.writeOut), gzip.DefaultCompression)
+			} else {
+				cw.w = enc.NewWriter(writerFunc(cw.writeOut))
+			}
+			if cw.w != nil {
+				cw.encoding = enc.Name()
+				// Detect the Content-Type eagerly, since net/http
+				// can't detect it from compressed bytes. Responses
+				// to HEAD requests have no body to detect it from.
+				if _, haveType := h["Content-Type"]; !haveType && !cw.head {
+					h.Set("Content-Type", http.DetectContentType(cw.buf))
+				}
+				h.Set("Content-Encoding", enc.Name())
+				addVary(h, "Accept-Encoding")
+				h.Del("Content-Length")
+				// Ranges of the compressed response can't be served.
+				h.Del("Accept-Ranges")
+				break
+			}
+		}
+	}
+	if cw.w != nil && cw.bufferSize > 0 {
+		if cw.bw == nil || cw.bw.Size() != cw.bufferSize {
+			cw.bw = bufio.NewWriterSize(cw.w, cw.bufferSize)
+		} else {
+			cw.bw.Reset(cw.w)
+		}
+	}
+	cw.rw.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = cw.buf[:0]
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.w != nil {
+		_, err = cw.compressor().Write(buf)
+	} else {
+		_, err = cw.writeOut(buf)
+	}
+	return err
+}
+
+// errWriteAfterClose is returned by writes to a CompressWriter after Close.
+var errWriteAfterClose = errors.New("httpgzip: write to CompressWriter after Close")
+
+// writerFunc is an adapter to allow the use of a function as an io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+// Flush implements http.Flusher. It writes out any buffered data,
+// compressing it if that has been decided, including data buffered
+// before compression (see CompressHandlerOptions.BufferSize), and flushes the underlying
+// ResponseWriter if it implements http.Flusher.
+func (cw *CompressWriter) Flush() {
+	if cw.closed {
+		return
+	}
+	cw.flushes++
+	if !cw.decided {
+		if !cw.wroteHeader {
+			cw.WriteHeader(http.StatusOK)
+		}
+		// Flushing means the response is streamed, which benefits
+		// from compression regardless of how much was written so far.
+		if err := cw.decide(true); err != nil {
+			return
+		}
+	}
+	if cw.w != nil && cw.bufferSize > 0 {
+		if err := cw.bw.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes writing the response. It doesn't close
+// the underlying ResponseWriter.
+func (cw *CompressWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	cw.duration = time.Since(cw.start)
+	if cw.hijacked {
+		return nil
+	}
+	if !cw.decided {
+		if !cw.wroteHeader && len(cw.buf) == 0 {
+			// Nothing was written, leave it to net/http.
+			return nil
+		}
+		compressible := len(cw.buf) > 0 && len(cw.buf) >= cw.minSize
+		if cw.head && len(cw.buf) == 0 {
+			// Handlers typically don't write the body of HEAD responses,
+			// so decide by their declared size, for headers to match GET.
+			size := cw.declaredSize()
+			compressible = size > 0 && size >= int64(cw.minSize)
+		}
+		if err := cw.decide(compressible); err != nil {
+			return err
+		}
+	}
+	if cw.w != nil {
+		if cw.bufferSize > 0 {
+			if err := cw.bw.Flush(); err != nil {
+				return err
+			}
+		}
+		return cw.w.Close()
+	}
+	return nil
+}
+
+// declaredSize returns the size of the body given by the "Content-Length"
+// header, or -1 if it's missing or invalid.
+func (cw *CompressWriter) declaredSize() int64 {
+	size, err := strconv.ParseInt(cw.Header().Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// Hijack implements http.Hijacker by delegating to the underlying ResponseWriter.
+func (cw *CompressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := cw.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter %T doesn't implement http.Hijacker", cw.rw)
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		cw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// bodyAllowed reports whether a given response status code permits a body.
+// See RFC 7230, section 3.3.
+func bodyAllowed(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
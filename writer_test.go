@@ -0,0 +1,101 @@
+package httpgzip_test
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shurcooL/httpgzip"
+)
+
+// Test that a CompressWriter can be reused via Reset, and flushes.
+func TestCompressWriterReset(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	cw := httpgzip.NewCompressWriter(rr, req)
+	io.WriteString(cw, "Hello ")
+	cw.Flush()
+	io.WriteString(cw, "world")
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !rr.Flushed {
+		t.Error("underlying ResponseWriter wasn't flushed")
+	}
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("got Content-Encoding %q, want %q", got, want)
+	}
+	gr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "Hello world"; got != want {
+		t.Errorf("got decompressed body %q, want %q", got, want)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	rr = httptest.NewRecorder()
+	cw.Reset(rr, req)
+	io.WriteString(cw, "Hello world")
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := rr.Header()["Content-Encoding"]; ok {
+		t.Errorf("after Reset: got Content-Encoding %q, want none", got)
+	}
+	if got, want := rr.Body.String(), "Hello world"; got != want {
+		t.Errorf("after Reset: got body %q, want %q", got, want)
+	}
+}
+
+// Test that closing a CompressWriter more than once is harmless,
+// and that writes after Close fail.
+func TestCompressWriterClose(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	cw := httpgzip.NewCompressWriter(rr, req)
+	cw.Flush() // Decides to compress.
+	for i := 0; i < 2; i++ {
+		if err := cw.Close(); err != nil {
+			t.Fatalf("Close %d: %v", i, err)
+		}
+	}
+	if _, err := io.WriteString(cw, "Hello world"); err == nil {
+		t.Error("Write after Close: got nil error, want non-nil")
+	}
+	if got, want := rr.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("got Content-Encoding %q, want %q", got, want)
+	}
+	gr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(gr); err != nil || len(b) != 0 {
+		t.Errorf("got decompressed body %q, %v; want empty", b, err)
+	}
+}
+
+// BenchmarkCompressWriter measures compressing responses with
+// CompressWriters reused via Reset.
+func BenchmarkCompressWriter(b *testing.B) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	body := []byte(strings.Repeat("This is some plain text that compresses easily. ", 64))
+	cw := new(httpgzip.CompressWriter)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		cw.Reset(httptest.NewRecorder(), req)
+		cw.Write(body)
+		cw.Close()
+	}
+}
@@ -0,0 +1,48 @@
+//go:build zstd
+// +build zstd
+
+package httpgzip
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// dynamicZstdSupported reports whether the package was built with
+// support for compressing zstd on the fly, via the zstd build tag.
+const dynamicZstdSupported = true
+
+// newZstdEncoderPool returns a pool of zstd encoders that compress
+// at the given level, as in the zstd command line tool.
+func newZstdEncoderPool(level int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			// NewWriter can't fail with only a level option.
+			enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+			return enc
+		},
+	}
+}
+
+// newZstdWriter returns an encoder from pool, which was returned by
+// newZstdEncoderPool, that writes the compressed data to w.
+func newZstdWriter(pool *sync.Pool, w io.Writer) io.WriteCloser {
+	e := pool.Get().(*zstd.Encoder)
+	e.Reset(w)
+	return pooledZstdEncoder{Encoder: e, pool: pool}
+}
+
+// pooledZstdEncoder is a zstd encoder that's returned to its pool when closed.
+type pooledZstdEncoder struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (e pooledZstdEncoder) Close() error {
+	err := e.Encoder.Close()
+	e.Encoder.Reset(nil)
+	e.pool.Put(e.Encoder)
+	return err
+}
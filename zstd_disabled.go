@@ -0,0 +1,19 @@
+//go:build !zstd
+// +build !zstd
+
+package httpgzip
+
+import (
+	"io"
+	"sync"
+)
+
+// dynamicZstdSupported reports whether the package was built with
+// support for compressing zstd on the fly, via the zstd build tag.
+const dynamicZstdSupported = false
+
+// newZstdEncoderPool is only available when built with the zstd build tag.
+func newZstdEncoderPool(level int) *sync.Pool { return nil }
+
+// newZstdWriter is only available when built with the zstd build tag.
+func newZstdWriter(pool *sync.Pool, w io.Writer) io.WriteCloser { return nil }
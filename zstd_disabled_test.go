@@ -0,0 +1,34 @@
+//go:build !zstd
+// +build !zstd
+
+package httpgzip_test
+
+import (
+	"testing"
+
+	"github.com/shurcooL/httpgzip"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// Test that FileServerOptions.ZstdLevel is invalid, and ignored, without
+// the zstd build tag, and that precompressed variants are still served.
+func TestServeContentZstdDisabled(t *testing.T) {
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":     compressibleText,
+		"bar.txt":     compressibleText,
+		"bar.txt.zst": "precompressed zstd",
+	}))
+	if err := (httpgzip.FileServerOptions{ZstdLevel: 3}).Validate(); err == nil {
+		t.Error("Validate with ZstdLevel didn't return an error")
+	}
+
+	// It's ignored by FileServer.
+	h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{ZstdLevel: 3, DebugHeader: true})
+	if got, want := serveGet(h, "/foo.txt", "zstd").Header().Get("X-Compression"), "identity"; got != want {
+		t.Errorf("got X-Compression %q, want %q", got, want)
+	}
+	if got, want := serveGet(h, "/bar.txt", "zstd").Header().Get("X-Compression"), "zstd-precompressed"; got != want {
+		t.Errorf("got X-Compression %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+//go:build zstd
+// +build zstd
+
+package httpgzip_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/shurcooL/httpgzip"
+	"golang.org/x/tools/godoc/vfs/httpfs"
+	"golang.org/x/tools/godoc/vfs/mapfs"
+)
+
+// Test that zstd is served from precompressed variants, and compressed
+// on the fly only if FileServerOptions.ZstdLevel is set.
+func TestServeContentZstd(t *testing.T) {
+	if err := (httpgzip.FileServerOptions{ZstdLevel: 3}).Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	fs := httpfs.New(mapfs.New(map[string]string{
+		"foo.txt":     compressibleText,
+		"bar.txt":     compressibleText,
+		"bar.txt.zst": "precompressed zstd",
+		"short.txt":   "short",
+	}))
+	tests := []struct {
+		path      string
+		zstdLevel int
+		want      string
+	}{
+		{path: "/foo.txt", zstdLevel: 0, want: "identity"},
+		{path: "/foo.txt", zstdLevel: 3, want: "zstd-dynamic"},
+		{path: "/bar.txt", zstdLevel: 0, want: "zstd-precompressed"},
+		{path: "/bar.txt", zstdLevel: 3, want: "zstd-precompressed"},
+		{path: "/short.txt", zstdLevel: 3, want: "identity"},
+	}
+	for _, tc := range tests {
+		h := httpgzip.FileServer(fs, httpgzip.FileServerOptions{ZstdLevel: tc.zstdLevel, DebugHeader: true})
+		// Serve more than once, to exercise reuse of pooled encoders.
+		for i := 0; i < 2; i++ {
+			rr := serveGet(h, tc.path, "zstd")
+			if got := rr.Header().Get("X-Compression"); got != tc.want {
+				t.Errorf("%s with ZstdLevel %v: got X-Compression %q, want %q", tc.path, tc.zstdLevel, got, tc.want)
+			}
+			if tc.want != "zstd-dynamic" {
+				continue
+			}
+			zr, err := zstd.NewReader(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(zr)
+			zr.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != compressibleText {
+				t.Errorf("%s with ZstdLevel %v: got decompressed body of length %d, want %d", tc.path, tc.zstdLevel, len(b), len(compressibleText))
+			}
+		}
+	}
+}